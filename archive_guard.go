@@ -0,0 +1,231 @@
+// archive_guard.go
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveLimits bounds the ZIP packages accepted for conversion.
+type ArchiveLimits struct {
+	// MaxUncompressedBytes caps the decompressed size of all entries,
+	// nested archives included
+	MaxUncompressedBytes int64
+	// MaxEntries caps the number of entries, nested archives included
+	MaxEntries int
+	// MaxCompressionRatio caps the uncompressed to compressed size ratio of
+	// entries larger than ratioGraceBytes
+	MaxCompressionRatio int
+	// MaxNestingDepth caps how deep archives may be embedded in each other;
+	// 0 rejects any embedded archive
+	MaxNestingDepth int
+}
+
+// DefaultArchiveLimits are used unless overridden by the ARCHIVE_* variables.
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxUncompressedBytes: 512 << 20,
+	MaxEntries:           10000,
+	MaxCompressionRatio:  100,
+	MaxNestingDepth:      2,
+}
+
+// ratioGraceBytes exempts small entries, which legitimately compress well,
+// from the compression ratio limit.
+const ratioGraceBytes = 1 << 20
+
+// loadArchiveLimits reads the ARCHIVE_* environment variables.
+func loadArchiveLimits() ArchiveLimits {
+	limits := DefaultArchiveLimits
+	limits.MaxUncompressedBytes = int64(envInt("ARCHIVE_MAX_UNCOMPRESSED_SIZE", int(limits.MaxUncompressedBytes)))
+	limits.MaxEntries = envInt("ARCHIVE_MAX_ENTRIES", limits.MaxEntries)
+	limits.MaxCompressionRatio = envInt("ARCHIVE_MAX_COMPRESSION_RATIO", limits.MaxCompressionRatio)
+	limits.MaxNestingDepth = envInt("ARCHIVE_MAX_NESTING_DEPTH", limits.MaxNestingDepth)
+	return limits
+}
+
+// ArchiveError reports why a package was rejected.
+type ArchiveError struct {
+	Code    string
+	Message string
+}
+
+func (e *ArchiveError) Error() string {
+	return e.Message
+}
+
+func archiveErrorf(code, format string, args ...any) *ArchiveError {
+	return &ArchiveError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// archiveCheck tracks the budget shared by an archive and the archives
+// nested in it.
+type archiveCheck struct {
+	limits       ArchiveLimits
+	entries      int
+	uncompressed int64
+	// spoolDir holds nested archives while they are checked
+	spoolDir string
+}
+
+// validateArchive checks the ZIP package at path against limits. Every entry
+// is decompressed so that sizes are measured rather than taken from headers,
+// and checksums are verified. Nested archives are spooled next to path.
+func validateArchive(path string, limits ArchiveLimits) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	check := &archiveCheck{limits: limits, spoolDir: filepath.Dir(path)}
+	return check.archive(f, info.Size(), 0)
+}
+
+func (c *archiveCheck) archive(r io.ReaderAt, size int64, depth int) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return archiveErrorf(ErrorCodeMalformedDocument, "Malformed archive: %v", err)
+	}
+
+	c.entries += len(archive.File)
+	if c.entries > c.limits.MaxEntries {
+		return archiveErrorf(ErrorCodeArchiveLimit,
+			"Archive has more than %d entries", c.limits.MaxEntries)
+	}
+
+	for _, file := range archive.File {
+		if err := c.entry(file, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *archiveCheck) entry(file *zip.File, depth int) error {
+	if file.Flags&0x1 != 0 {
+		return archiveErrorf(ErrorCodeEncryptedDocument, "Encrypted documents are not supported")
+	}
+	if file.Mode().IsDir() {
+		return nil
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return archiveErrorf(ErrorCodeMalformedDocument, "Malformed archive entry %q: %v", file.Name, err)
+	}
+	defer rc.Close()
+
+	// Read one byte past the remaining budget to detect overruns
+	remaining := c.limits.MaxUncompressedBytes - c.uncompressed
+	var head bytes.Buffer
+	n, err := io.Copy(&entrySniffer{head: &head}, io.LimitReader(rc, remaining+1))
+	if err != nil {
+		return archiveErrorf(ErrorCodeMalformedDocument, "Malformed archive entry %q: %v", file.Name, err)
+	}
+	c.uncompressed += n
+	if c.uncompressed > c.limits.MaxUncompressedBytes {
+		return archiveErrorf(ErrorCodeArchiveLimit,
+			"Archive expands to more than %d bytes", c.limits.MaxUncompressedBytes)
+	}
+
+	if n > ratioGraceBytes {
+		compressed := max(int64(file.CompressedSize64), 1)
+		if n/compressed > int64(c.limits.MaxCompressionRatio) {
+			return archiveErrorf(ErrorCodeArchiveLimit,
+				"Archive entry %q exceeds the compression ratio limit of %d", file.Name, c.limits.MaxCompressionRatio)
+		}
+	}
+
+	if file.Name == "META-INF/manifest.xml" && odfManifestEncrypted(file) {
+		return archiveErrorf(ErrorCodeEncryptedDocument, "Encrypted documents are not supported")
+	}
+
+	if bytes.HasPrefix(head.Bytes(), zipMagic) {
+		return c.nested(file, depth+1)
+	}
+	return nil
+}
+
+// nested checks an archive embedded in another one.
+func (c *archiveCheck) nested(file *zip.File, depth int) error {
+	if depth > c.limits.MaxNestingDepth {
+		return archiveErrorf(ErrorCodeArchiveLimit,
+			"Archive entry %q nests archives deeper than %d levels", file.Name, c.limits.MaxNestingDepth)
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return archiveErrorf(ErrorCodeMalformedDocument, "Malformed archive entry %q: %v", file.Name, err)
+	}
+	defer rc.Close()
+
+	// Spool the entry to disk rather than holding up to the whole size
+	// budget in memory
+	spool, err := os.CreateTemp(c.spoolDir, "nested-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// The entry decompressed cleanly before, so failures are the spool's
+	size, err := io.Copy(spool, rc)
+	if err != nil {
+		return fmt.Errorf("spool archive entry %q: %w", file.Name, err)
+	}
+
+	return c.archive(spool, size, depth)
+}
+
+// entrySniffer discards what is written to it except the first few bytes.
+type entrySniffer struct {
+	head *bytes.Buffer
+}
+
+func (s *entrySniffer) Write(p []byte) (int, error) {
+	if missing := len(zipMagic) - s.head.Len(); missing > 0 {
+		s.head.Write(p[:min(missing, len(p))])
+	}
+	return len(p), nil
+}
+
+// odfManifestEncrypted reports whether an ODF manifest declares encrypted
+// entries. Unreadable manifests are left to LibreOffice.
+func odfManifestEncrypted(file *zip.File) bool {
+	rc, err := file.Open()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	decoder := xml.NewDecoder(io.LimitReader(rc, 1<<20))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok && strings.EqualFold(start.Name.Local, "encryption-data") {
+			return true
+		}
+	}
+}
+
+// asArchiveError returns the rejection reason in err, if err rejects the
+// upload rather than being an internal failure.
+func asArchiveError(err error) (*ArchiveError, bool) {
+	var archiveErr *ArchiveError
+	ok := errors.As(err, &archiveErr)
+	return archiveErr, ok
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zipEntry is an entry of a test archive.
+type zipEntry struct {
+	name   string
+	data   []byte
+	method uint16
+	flags  uint16
+}
+
+func buildZip(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method, Flags: e.flags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// nestZip returns an archive nesting inner depth times.
+func nestZip(t *testing.T, inner []byte, depth int) []byte {
+	t.Helper()
+	for i := 0; i < depth; i++ {
+		inner = buildZip(t, zipEntry{name: fmt.Sprintf("level%d.zip", i), data: inner, method: zip.Store})
+	}
+	return inner
+}
+
+func TestValidateArchive(t *testing.T) {
+	limits := ArchiveLimits{
+		MaxUncompressedBytes: 4 << 20,
+		MaxEntries:           10,
+		MaxCompressionRatio:  100,
+		MaxNestingDepth:      2,
+	}
+	tooMany := make([]zipEntry, 11)
+	for i := range tooMany {
+		tooMany[i] = zipEntry{name: fmt.Sprintf("entry%d.xml", i), data: []byte("x")}
+	}
+	document := buildZip(t, zipEntry{name: "[Content_Types].xml", data: []byte(docxTypes), method: zip.Deflate})
+
+	tests := []struct {
+		name    string
+		archive []byte
+		code    string
+	}{
+		{"valid", document, ""},
+		{"too many entries", buildZip(t, tooMany...), ErrorCodeArchiveLimit},
+		{"compression ratio", buildZip(t, zipEntry{name: "zeros.xml", data: make([]byte, 2<<20), method: zip.Deflate}), ErrorCodeArchiveLimit},
+		{"uncompressed size", buildZip(t, zipEntry{name: "big.bin", data: make([]byte, 5<<20), method: zip.Store}), ErrorCodeArchiveLimit},
+		{"nested within depth", nestZip(t, document, 2), ""},
+		{"nested too deep", nestZip(t, document, 3), ErrorCodeArchiveLimit},
+		{"nested entries count", nestZip(t, buildZip(t, tooMany[:10]...), 1), ErrorCodeArchiveLimit},
+		{"encrypted", buildZip(t, zipEntry{name: "word/document.xml", data: []byte("x"), flags: 0x1}), ErrorCodeEncryptedDocument},
+		{"malformed", []byte("PK\x03\x04 not really a zip"), ErrorCodeMalformedDocument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "original.docx")
+			if err := os.WriteFile(path, tt.archive, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := validateArchive(path, limits)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("validateArchive: %v", err)
+				}
+			} else if archiveErr, ok := asArchiveError(err); !ok || archiveErr.Code != tt.code {
+				t.Fatalf("validateArchive = %v, want error code %s", err, tt.code)
+			}
+
+			// Spooled nested archives are removed
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("%d files left next to the archive, want only the archive", len(entries))
+			}
+		})
+	}
+}
+
+func TestUploadRejectsArchiveBomb(t *testing.T) {
+	ts := newTestServer(t)
+	bomb := buildZip(t,
+		zipEntry{name: "[Content_Types].xml", data: []byte(docxTypes), method: zip.Deflate},
+		zipEntry{name: "word/document.xml", data: make([]byte, 8<<20), method: zip.Deflate},
+	)
+
+	resp := ts.postConvert(t, "bomb.docx", bomb, "pdf")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("upload: status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	var body struct {
+		ErrorCode string `json:"error_code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ErrorCode != ErrorCodeArchiveLimit {
+		t.Errorf("error_code = %q, want %q", body.ErrorCode, ErrorCodeArchiveLimit)
+	}
+	if len(ts.backend.Calls()) != 0 {
+		t.Error("rejected archive reached the backend")
+	}
+}
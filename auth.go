@@ -0,0 +1,261 @@
+// auth.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"document-converter/services"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles of API keys
+const (
+	// RoleUser keys see and manage only the jobs they created
+	RoleUser = "user"
+	// RoleAdmin keys see every job and manage API keys
+	RoleAdmin = "admin"
+)
+
+// Error codes of requests refused by authentication
+const (
+	ErrorCodeUnauthorized = "unauthorized"
+	ErrorCodeForbidden    = "forbidden"
+)
+
+// bootstrapKeyID is the ID of the admin key configured with ADMIN_API_KEY.
+const bootstrapKeyID = "bootstrap"
+
+// apiKeyPrefix marks generated keys, so leaked keys are easy to search for.
+const apiKeyPrefix = "dck_"
+
+// publicPaths are served without an API key; the panel asks for one itself.
+var publicPaths = map[string]bool{
+	"/":      true,
+	"/panel": true,
+}
+
+type callerKey struct{}
+
+// caller returns the API key that authenticated r.
+func caller(r *http.Request) *services.APIKey {
+	key, _ := r.Context().Value(callerKey{}).(*services.APIKey)
+	return key
+}
+
+// canAccess reports whether key may see and manage job. Jobs created before
+// authentication existed have no owner and are only visible to admins.
+func canAccess(key *services.APIKey, job *services.ConvertJob) bool {
+	return canAccessOwner(key, job.Owner)
+}
+
+// canAccessOwner reports whether key may see the jobs of owner.
+func canAccessOwner(key *services.APIKey, owner string) bool {
+	if key == nil {
+		return false
+	}
+	return key.Role == RoleAdmin || (owner != "" && owner == key.ID)
+}
+
+// hashAPIKey returns the hex SHA-256 of key, as stored in the database.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random key.
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requestAPIKey extracts the key from the Authorization bearer token or the
+// X-API-Key header. Browsers cannot set headers on WebSocket requests, so
+// /ws also accepts the api_key query parameter.
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if r.URL.Path == "/ws" {
+		return r.URL.Query().Get("api_key")
+	}
+	return ""
+}
+
+// authMiddleware rejects requests without a valid API key and makes the key
+// available to handlers through caller.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret := requestAPIKey(r)
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "API key required")
+			return
+		}
+
+		key, err := s.db.GetAPIKeyByHash(hashAPIKey(secret))
+		if errors.Is(err, sql.ErrNoRows) {
+			s.logger.Warn("rejected invalid api key",
+				"path", r.URL.Path,
+				"remote_addr", r.RemoteAddr,
+			)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "Invalid API key")
+			return
+		}
+		if err != nil {
+			s.logger.Error("failed to look up api key", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, key)))
+	})
+}
+
+// requireAdmin restricts next to admin keys.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := caller(r); key == nil || key.Role != RoleAdmin {
+			writeJSONError(w, http.StatusForbidden, ErrorCodeForbidden, "Admin API key required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bootstrapAdminKey stores the ADMIN_API_KEY as the bootstrap admin key.
+// Changing the variable rotates the key.
+func (s *Server) bootstrapAdminKey(secret string) error {
+	return s.db.PutAPIKey(&services.APIKey{
+		ID:        bootstrapKeyID,
+		Name:      "ADMIN_API_KEY",
+		KeyHash:   hashAPIKey(secret),
+		Role:      RoleAdmin,
+		CreatedAt: time.Now(),
+	})
+}
+
+// CreatedAPIKey is returned once when a key is created; only its hash is
+// kept.
+type CreatedAPIKey struct {
+	*services.APIKey
+	Key string `json:"key"`
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.db.GetAPIKeys()
+	if err != nil {
+		s.logger.Error("failed to get api keys", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []*services.APIKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name   string          `json:"name"`
+		Role   string          `json:"role"`
+		Quotas services.Quotas `json:"quotas"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if request.Role == "" {
+		request.Role = RoleUser
+	}
+	if request.Role != RoleUser && request.Role != RoleAdmin {
+		http.Error(w, "role must be user or admin", http.StatusBadRequest)
+		return
+	}
+	if !validQuotas(request.Quotas) {
+		http.Error(w, "Quotas must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := generateAPIKey()
+	if err != nil {
+		s.logger.Error("failed to generate api key", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	key := &services.APIKey{
+		ID:        uuid.New().String(),
+		Name:      strings.TrimSpace(request.Name),
+		KeyHash:   hashAPIKey(secret),
+		Role:      request.Role,
+		Quotas:    request.Quotas,
+		CreatedAt: time.Now(),
+	}
+	if err := s.db.CreateAPIKey(key); err != nil {
+		s.logger.Error("failed to create api key", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("api key created",
+		"key_id", key.ID,
+		"name", key.Name,
+		"role", key.Role,
+		"created_by", caller(r).ID,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api-keys/"+key.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIKey{APIKey: key, Key: secret})
+}
+
+func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	deleted, err := s.db.DeleteAPIKey(id)
+	if err != nil {
+		s.logger.Error("failed to delete api key", "error", err, "key_id", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	s.disconnectKey(id)
+
+	s.logger.Info("api key revoked",
+		"key_id", id,
+		"revoked_by", caller(r).ID,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"document-converter/services"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// createKey creates an API key with the admin key and returns it.
+func (ts *testServer) createKey(t *testing.T, name, role string, quotas services.Quotas) CreatedAPIKey {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{"name": name, "role": role, "quotas": quotas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := ts.as(testAPIKey).do(t, http.MethodPost, "/api-keys", bytes.NewReader(body), "application/json")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api-keys: status %d", resp.StatusCode)
+	}
+	var created CreatedAPIKey
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding created key: %v", err)
+	}
+	return created
+}
+
+func TestAuthRequiresKey(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"missing", "", "", http.StatusUnauthorized},
+		{"invalid", "Authorization", "Bearer dck_not-a-key", http.StatusUnauthorized},
+		{"bearer", "Authorization", "Bearer " + testAPIKey, http.StatusOK},
+		{"header", "X-API-Key", testAPIKey, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.http.URL+"/converts", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			resp, err := ts.http.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("GET /converts: status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewarePublicPaths(t *testing.T) {
+	ts := newTestServer(t)
+	handler := ts.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/panel", http.StatusOK},
+		{http.MethodPost, "/panel", http.StatusUnauthorized},
+		{http.MethodGet, "/converts", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s without a key: status %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestJobOwnership(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.as(ts.createKey(t, "alice", RoleUser, services.Quotas{}).Key)
+	bob := ts.as(ts.createKey(t, "bob", RoleUser, services.Quotas{}).Key)
+
+	id := alice.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+
+	// Other users' jobs do not exist for them
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/converts/" + id},
+		{http.MethodGet, "/convert-outcomes/" + id},
+		{http.MethodGet, "/converts/" + id + "/events"},
+		{http.MethodPost, "/converts/" + id + "/retry"},
+		{http.MethodDelete, "/converts/" + id},
+	} {
+		if resp := bob.do(t, route.method, route.path, nil, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s by another user: status %d, want 404", route.method, route.path, resp.StatusCode)
+		}
+	}
+
+	var listed []JobResponse
+	if err := json.NewDecoder(bob.do(t, http.MethodGet, "/converts", nil, "").Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 0 {
+		t.Errorf("another user lists %d jobs, want none", len(listed))
+	}
+
+	// The owner and admins see the job
+	if job := alice.getJob(t, id); job.Status != StatusComplete {
+		t.Errorf("owner sees status %q, want %q", job.Status, StatusComplete)
+	}
+	if job := ts.getJob(t, id); job.ID != id {
+		t.Errorf("admin sees job %q, want %q", job.ID, id)
+	}
+}
+
+func TestAPIKeyManagementIsAdminOnly(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.createKey(t, "user", RoleUser, services.Quotas{})
+
+	if resp := ts.as(user.Key).do(t, http.MethodGet, "/api-keys", nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /api-keys by a user: status %d, want 403", resp.StatusCode)
+	}
+
+	if resp := ts.do(t, http.MethodDelete, "/api-keys/"+user.ID, nil, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /api-keys/%s: status %d", user.ID, resp.StatusCode)
+	}
+	if resp := ts.as(user.Key).do(t, http.MethodGet, "/converts", nil, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /converts with a revoked key: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestCanAccessOwner(t *testing.T) {
+	admin := &services.APIKey{ID: "admin", Role: RoleAdmin}
+	user := &services.APIKey{ID: "user", Role: RoleUser}
+
+	tests := []struct {
+		key   *services.APIKey
+		owner string
+		want  bool
+	}{
+		{admin, "user", true},
+		{admin, "", true},
+		{user, "user", true},
+		{user, "other", false},
+		// Jobs from before authentication belong to admins only
+		{user, "", false},
+		{nil, "user", false},
+	}
+	for _, tt := range tests {
+		if got := canAccessOwner(tt.key, tt.owner); got != tt.want {
+			t.Errorf("canAccessOwner(%v, %q) = %v, want %v", tt.key, tt.owner, got, tt.want)
+		}
+	}
+}
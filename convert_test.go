@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"document-converter/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "test-admin-key"
+
+// docxTypes is the [Content_Types].xml of a minimal Word document.
+const docxTypes = `<?xml version="1.0" encoding="UTF-8"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+</Types>`
+
+// testServer is a server using the fake backend selected by
+// CONVERTER_BACKEND, with an admin key and no workers running.
+type testServer struct {
+	*Server
+	backend *FakeBackend
+	http    *httptest.Server
+	// key authenticates the requests of do
+	key string
+}
+
+// as returns a copy of ts making requests with key.
+func (ts *testServer) as(key string) *testServer {
+	c := *ts
+	c.key = key
+	return &c
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	t.Setenv("CONVERTER_BACKEND", "fake")
+	t.Setenv("RATE_LIMIT_PER_MINUTE", "0")
+
+	dir := t.TempDir()
+	testLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	db, err := services.InitDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	backend, err := newBackend(os.Getenv("CONVERTER_BACKEND"), dir, testLogger)
+	if err != nil {
+		t.Fatalf("newBackend: %v", err)
+	}
+	fake, ok := backend.(*FakeBackend)
+	if !ok {
+		t.Fatalf("CONVERTER_BACKEND=fake returned %T", backend)
+	}
+
+	server := NewServer(NewConverter(dir, testLogger, backend), db, testLogger)
+	if server.events, err = NewEventBus(db, testLogger); err != nil {
+		t.Fatalf("NewEventBus: %v", err)
+	}
+	t.Cleanup(server.events.Close)
+	if err := server.bootstrapAdminKey(testAPIKey); err != nil {
+		t.Fatalf("bootstrapAdminKey: %v", err)
+	}
+
+	ts := httptest.NewServer(server.routes())
+	t.Cleanup(ts.Close)
+
+	return &testServer{Server: server, backend: fake, http: ts, key: testAPIKey}
+}
+
+// makeDocx returns a minimal Word document containing text.
+func makeDocx(t *testing.T, text string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"[Content_Types].xml": docxTypes,
+		"word/document.xml":   text,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func (ts *testServer) do(t *testing.T, method, path string, body io.Reader, contentType string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.http.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+ts.key)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// postConvert posts a document for conversion to format.
+func (ts *testServer) postConvert(t *testing.T, name string, content []byte, format string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	mw.WriteField("target_format", format)
+	mw.Close()
+
+	return ts.do(t, http.MethodPost, "/converts", &body, mw.FormDataContentType())
+}
+
+// upload posts a document for conversion to format and returns the job ID.
+func (ts *testServer) upload(t *testing.T, name string, content []byte, format string) string {
+	t.Helper()
+	resp := ts.postConvert(t, name, content, format)
+	if resp.StatusCode != http.StatusAccepted {
+		data, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST /converts: status %d: %s", resp.StatusCode, data)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding created job: %v", err)
+	}
+	return created.ID
+}
+
+// work claims the next queued job and converts it as a worker would.
+func (ts *testServer) work(t *testing.T) {
+	t.Helper()
+	job, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing)
+	if err != nil {
+		t.Fatalf("ClaimNextJob: %v", err)
+	}
+	ts.processConversion(job)
+}
+
+func (ts *testServer) getJob(t *testing.T, id string) JobResponse {
+	t.Helper()
+	resp := ts.do(t, http.MethodGet, "/converts/"+id, nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /converts/%s: status %d", id, resp.StatusCode)
+	}
+	var job JobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatalf("decoding job: %v", err)
+	}
+	return job
+}
+
+func TestConvertWithFakeBackend(t *testing.T) {
+	ts := newTestServer(t)
+	content := makeDocx(t, "hello")
+
+	id := ts.upload(t, "report.docx", content, "pdf")
+	if job := ts.getJob(t, id); job.Status != StatusQueued {
+		t.Fatalf("status after upload = %q, want %q", job.Status, StatusQueued)
+	}
+
+	ts.work(t)
+
+	job := ts.getJob(t, id)
+	if job.Status != StatusComplete {
+		t.Fatalf("status = %q (%s), want %q", job.Status, job.Error, StatusComplete)
+	}
+	if len(job.Links) != 2 || job.Links[1].Rel != "download" {
+		t.Errorf("links = %+v, want self and download", job.Links)
+	}
+
+	resp := ts.do(t, http.MethodGet, "/convert-outcomes/"+id, nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download: status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("download Content-Type = %q, want application/pdf", got)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake names the stored upload, so only check what it converted
+	want := fmt.Sprintf("(%d bytes, sha256 %x)\n", len(content), sha256.Sum256(content))
+	if !bytes.HasPrefix(data, []byte("fake pdf conversion of ")) || !bytes.HasSuffix(data, []byte(want)) {
+		t.Errorf("download = %q, want fake pdf conversion ending in %q", data, want)
+	}
+
+	calls := ts.backend.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("backend called %d times, want 1", len(calls))
+	}
+	if calls[0].JobID != id || calls[0].Format.Name != "pdf" {
+		t.Errorf("backend called with %+v, want job %s to pdf", calls[0], id)
+	}
+}
+
+func TestConvertFakeBackendFailure(t *testing.T) {
+	ts := newTestServer(t)
+	ts.backend.Err = errors.New("fake failure")
+
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "odt")
+	ts.work(t)
+
+	job := ts.getJob(t, id)
+	if job.Status != StatusFailed {
+		t.Fatalf("status = %q, want %q", job.Status, StatusFailed)
+	}
+	if job.ErrorCode != ErrorCodeConversionFailed {
+		t.Errorf("error_code = %q, want %q", job.ErrorCode, ErrorCodeConversionFailed)
+	}
+	if len(job.Links) != 1 {
+		t.Errorf("links = %+v, want only self", job.Links)
+	}
+
+	resp := ts.do(t, http.MethodGet, "/convert-outcomes/"+id, nil, "")
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("download of failed job succeeded")
+	}
+
+	calls := ts.backend.Calls()
+	if len(calls) != 1 || calls[0].Format.Name != "odt" {
+		t.Errorf("backend calls = %+v, want one odt conversion", calls)
+	}
+}
+
+func TestConvertFakeBackendTimeout(t *testing.T) {
+	t.Setenv("FAKE_BACKEND_DELAY", "5s")
+	ts := newTestServer(t)
+	if ts.backend.Delay != 5*time.Second {
+		t.Fatalf("FAKE_BACKEND_DELAY gave delay %s, want 5s", ts.backend.Delay)
+	}
+	ts.converter.defaultTimeout = 50 * time.Millisecond
+
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	start := time.Now()
+	ts.work(t)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("conversion took %s, want it cut off by the timeout", elapsed)
+	}
+
+	job := ts.getJob(t, id)
+	if job.Status != StatusFailed || job.ErrorCode != ErrorCodeTimeout {
+		t.Fatalf("status = %q, error_code = %q, want %q with %q", job.Status, job.ErrorCode, StatusFailed, ErrorCodeTimeout)
+	}
+	if len(ts.backend.Calls()) != 1 {
+		t.Errorf("backend called %d times, want 1", len(ts.backend.Calls()))
+	}
+}
+
+func TestNewBackendInvalidFakeDelay(t *testing.T) {
+	t.Setenv("FAKE_BACKEND_DELAY", "soon")
+	if _, err := newBackend("fake", t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Fatal("newBackend accepted an invalid FAKE_BACKEND_DELAY")
+	}
+}
+
+func TestListConvertsEmpty(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp := ts.do(t, http.MethodGet, "/converts", nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /converts: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(bytes.TrimSpace(data)); got != "[]" {
+		t.Errorf("GET /converts = %s, want []", got)
+	}
+}
@@ -0,0 +1,321 @@
+// converter.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConvertOptions carries the per-job settings passed to a Backend.
+type ConvertOptions struct {
+	JobID  string
+	Format OutputFormat
+}
+
+// Artifact is a file produced by a conversion.
+type Artifact struct {
+	Path     string
+	MimeType string
+}
+
+// Backend converts a single input file into outputDir.
+type Backend interface {
+	Convert(ctx context.Context, input, outputDir string, opts ConvertOptions) ([]Artifact, error)
+}
+
+// ConversionError is returned by a Backend when the conversion itself failed.
+// Code and Message are recorded on the job and are safe to show to API clients.
+type ConversionError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *ConversionError) Error() string {
+	return e.Message
+}
+
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultConversionTimeout bounds a conversion when no timeout is configured.
+const DefaultConversionTimeout = 5 * time.Minute
+
+type Converter struct {
+	tempDir string
+	logger  *slog.Logger
+	backend Backend
+
+	// defaultTimeout applies to formats without an entry in formatTimeouts
+	defaultTimeout time.Duration
+	formatTimeouts map[string]time.Duration
+}
+
+func NewConverter(tempDir string, logger *slog.Logger, backend Backend) *Converter {
+	return &Converter{
+		tempDir:        tempDir,
+		logger:         logger,
+		backend:        backend,
+		defaultTimeout: DefaultConversionTimeout,
+		formatTimeouts: make(map[string]time.Duration),
+	}
+}
+
+// loadTimeouts reads CONVERSION_TIMEOUT and the per-format
+// CONVERSION_TIMEOUT_<FORMAT> overrides, e.g. CONVERSION_TIMEOUT_PDF=10m.
+func (c *Converter) loadTimeouts() {
+	if timeout := os.Getenv("CONVERSION_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil && d > 0 {
+			c.defaultTimeout = d
+		} else {
+			c.logger.Warn("ignoring invalid conversion timeout", "value", timeout)
+		}
+	}
+
+	for name := range outputFormats {
+		key := "CONVERSION_TIMEOUT_" + strings.ToUpper(name)
+		timeout := os.Getenv(key)
+		if timeout == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(timeout); err == nil && d > 0 {
+			c.formatTimeouts[name] = d
+		} else {
+			c.logger.Warn("ignoring invalid conversion timeout", "variable", key, "value", timeout)
+		}
+	}
+}
+
+// timeoutFor returns the conversion deadline for format.
+func (c *Converter) timeoutFor(format OutputFormat) time.Duration {
+	if d, ok := c.formatTimeouts[format.Name]; ok {
+		return d
+	}
+	return c.defaultTimeout
+}
+
+// Convert runs the configured backend for a job, bounded by the timeout of
+// the target format.
+func (c *Converter) Convert(ctx context.Context, input, outputDir string, opts ConvertOptions) ([]Artifact, error) {
+	timeout := c.timeoutFor(opts.Format)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	artifacts, err := c.backend.Convert(ctx, input, outputDir, opts)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		c.logger.Error("conversion timed out",
+			"timeout", timeout,
+			"job_id", opts.JobID,
+		)
+		return nil, &ConversionError{
+			Code:    ErrorCodeTimeout,
+			Message: fmt.Sprintf("Conversion timed out after %s", timeout),
+			Err:     err,
+		}
+	}
+	return artifacts, err
+}
+
+// profilesDirName is the directory under the temp dir holding the
+// per-conversion LibreOffice user profiles.
+const profilesDirName = "profiles"
+
+// newBackend returns the backend named by CONVERTER_BACKEND.
+func newBackend(name, tempDir string, logger *slog.Logger) (Backend, error) {
+	switch strings.ToLower(name) {
+	case "", "libreoffice":
+		backend, err := NewLibreOfficeBackend(filepath.Join(tempDir, profilesDirName), logger)
+		if err != nil {
+			return nil, err
+		}
+		config, err := loadSandboxConfig()
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			if backend.sandbox, err = NewSandbox(*config); err != nil {
+				return nil, err
+			}
+			logger.Info("running libreoffice in sandbox",
+				"cpu_seconds", config.CPUSeconds,
+				"address_space_bytes", config.AddressSpaceBytes,
+				"open_files", config.OpenFiles,
+				"file_size_bytes", config.FileSizeBytes,
+			)
+		}
+		return backend, nil
+	case "fake":
+		backend := &FakeBackend{}
+		if delay := os.Getenv("FAKE_BACKEND_DELAY"); delay != "" {
+			d, err := time.ParseDuration(delay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FAKE_BACKEND_DELAY: %w", err)
+			}
+			backend.Delay = d
+		}
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unknown converter backend %q", name)
+	}
+}
+
+// LibreOfficeBackend converts documents by running libreoffice --headless.
+// Every conversion gets its own user profile under profileDir, because
+// instances sharing a profile lock each other out and exit without output.
+type LibreOfficeBackend struct {
+	binary     string
+	profileDir string
+	logger     *slog.Logger
+
+	// sandbox, when set, confines LibreOffice to the output and profile
+	// directories without network access
+	sandbox *Sandbox
+}
+
+// NewLibreOfficeBackend prepares profileDir, removing profiles left behind
+// by a previous run.
+func NewLibreOfficeBackend(profileDir string, logger *slog.Logger) (*LibreOfficeBackend, error) {
+	profileDir, err := filepath.Abs(profileDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(profileDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &LibreOfficeBackend{
+		binary:     "libreoffice",
+		profileDir: profileDir,
+		logger:     logger,
+	}, nil
+}
+
+// newProfile creates an empty user profile directory and returns its path
+// together with the -env:UserInstallation argument pointing at it.
+func (b *LibreOfficeBackend) newProfile() (string, string, error) {
+	dir, err := os.MkdirTemp(b.profileDir, "profile-")
+	if err != nil {
+		return "", "", err
+	}
+	profileURL := url.URL{Scheme: "file", Path: filepath.ToSlash(dir)}
+	return dir, "-env:UserInstallation=" + profileURL.String(), nil
+}
+
+// processWaitDelay bounds how long we wait for LibreOffice's output pipes to
+// close after the process was killed; forked helpers may still hold them.
+const processWaitDelay = 5 * time.Second
+
+func (b *LibreOfficeBackend) Convert(ctx context.Context, input, outputDir string, opts ConvertOptions) ([]Artifact, error) {
+	profile, profileArg, err := b.newProfile()
+	if err != nil {
+		return nil, fmt.Errorf("create libreoffice profile: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(profile); err != nil {
+			b.logger.Warn("failed to remove libreoffice profile",
+				"error", err,
+				"path", profile,
+				"job_id", opts.JobID,
+			)
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx,
+		b.binary,
+		profileArg,
+		"--convert-to", opts.Format.Filter,
+		"--headless",
+		"--outdir", outputDir,
+		input,
+	)
+
+	// soffice forks oosplash and soffice.bin; run them in their own process
+	// group so expiry of ctx kills all of them, not just the launcher
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = processWaitDelay
+
+	if b.sandbox != nil {
+		// Everything outside these directories is read-only
+		cmd.Env = sandboxEnv(os.Environ(), profile)
+		if err := b.sandbox.Wrap(cmd, outputDir, profile); err != nil {
+			return nil, fmt.Errorf("sandbox libreoffice: %w", err)
+		}
+	}
+
+	output, err := cmd.CombinedOutput()
+	outputStr := string(output)
+
+	// Check for specific error patterns in the output
+	if err != nil || strings.Contains(outputStr, "Error:") || strings.Contains(outputStr, "failed:") {
+		b.logger.Error("libreoffice conversion failed",
+			"error", err,
+			"output", outputStr,
+			"command", cmd.String(),
+			"job_id", opts.JobID,
+		)
+		if err == nil {
+			err = errors.New("libreoffice reported an error")
+		}
+		return nil, &ConversionError{
+			Code:    ErrorCodeConversionFailed,
+			Message: libreOfficeErrorMessage(outputStr),
+			Err:     err,
+		}
+	}
+
+	// Log successful conversion
+	b.logger.Info("libreoffice conversion completed",
+		"output", outputStr,
+		"job_id", opts.JobID,
+	)
+
+	// LibreOffice names the output after the input file
+	baseName := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	convertedFile := filepath.Join(outputDir, baseName+opts.Format.Extension)
+
+	// Verify converted file exists
+	if _, err := os.Stat(convertedFile); os.IsNotExist(err) {
+		b.logger.Error("converted file not found after conversion",
+			"expected_file", convertedFile,
+			"job_id", opts.JobID,
+		)
+		return nil, &ConversionError{
+			Code:    ErrorCodeConversionFailed,
+			Message: "Converted file not found after conversion",
+			Err:     err,
+		}
+	}
+
+	return []Artifact{{Path: convertedFile, MimeType: opts.Format.MimeType}}, nil
+}
+
+// libreOfficeErrorMessage extracts the first "Error:" line from the
+// LibreOffice output, falling back to a generic message.
+func libreOfficeErrorMessage(output string) string {
+	idx := strings.Index(output, "Error:")
+	if idx == -1 {
+		return "Conversion failed"
+	}
+
+	// Extract error message between "Error:" and the next newline
+	errorPart := output[idx:]
+	if newLineIdx := strings.Index(errorPart, "\n"); newLineIdx != -1 {
+		return errorPart[:newLineIdx]
+	}
+	return errorPart
+}
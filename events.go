@@ -0,0 +1,548 @@
+// events.go
+package main
+
+import (
+	"document-converter/services"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of job events, shared by the WebSocket and Server-Sent Events streams
+const (
+	EventJobUpdate = "job_update"
+	EventJobDelete = "job_delete"
+)
+
+const (
+	// streamBufferSize is the number of events buffered per stream; streams
+	// falling further behind are closed and resume with Last-Event-ID
+	streamBufferSize = 64
+	// streamHeartbeatInterval keeps proxies from closing idle streams
+	streamHeartbeatInterval = 20 * time.Second
+	// streamRetry is the reconnection delay suggested to EventSource clients
+	streamRetry = 3 * time.Second
+	// replayPageSize is the number of recorded events read at a time when
+	// replaying missed events
+	replayPageSize = 500
+)
+
+// Limits of the JSON event lists
+const (
+	DefaultEventLimit = 100
+	MaxEventLimit     = 1000
+	// DefaultEventWait and MaxEventWait bound how long requests with after
+	// wait for an event
+	DefaultEventWait = 30 * time.Second
+	MaxEventWait     = 60 * time.Second
+	// DefaultEventRetention is how long events are kept unless
+	// EVENT_RETENTION overrides it
+	DefaultEventRetention = 7 * 24 * time.Hour
+)
+
+// Event is a job change published on the event bus.
+type Event struct {
+	// Seq orders the events; it is kept across restarts
+	Seq   uint64
+	Type  string
+	JobID string
+	// Owner is the API key owning the job, for filtering
+	Owner string
+	// Data is the JSON message sent to clients
+	Data []byte
+}
+
+// eventFromRecord returns the event of a recorded job event.
+func eventFromRecord(e *services.JobEvent) Event {
+	return Event{
+		Seq:   e.Seq,
+		Type:  e.Type,
+		JobID: e.JobID,
+		Owner: e.Owner,
+		Data:  e.Message,
+	}
+}
+
+// EventBus records job events in the database and fans them out to the
+// WebSocket hub and the event streams. Publishing only takes a sequence
+// number; a writer goroutine records and delivers the events in sequence
+// order, so publishers never wait for the database or for subscribers.
+type EventBus struct {
+	db     *services.DB
+	logger *slog.Logger
+
+	// mu guards the sequence and the events waiting for the writer; cond
+	// signals new pending events and written ones
+	mu      sync.Mutex
+	cond    *sync.Cond
+	seq     uint64
+	pending []*pendingEvent
+	written uint64
+	closed  bool
+	done    chan struct{}
+
+	subsMu sync.Mutex
+	subs   map[*Subscription]bool
+}
+
+// pendingEvent is a published event waiting for the writer. Events become
+// ready once their message is marshaled.
+type pendingEvent struct {
+	Event
+	ready bool
+}
+
+// Subscription receives the events matching its filter on C. C is closed when
+// the subscription ends, either by Unsubscribe or because a lossy
+// subscription fell behind.
+type Subscription struct {
+	C      chan Event
+	filter func(Event) bool
+	// lossless subscriptions are never dropped; delivery waits for them
+	lossless bool
+}
+
+// NewEventBus returns a bus continuing the sequence numbers recorded in db.
+// Close stops its writer.
+func NewEventBus(db *services.DB, logger *slog.Logger) (*EventBus, error) {
+	seq, err := db.LastJobEventSeq()
+	if err != nil {
+		return nil, err
+	}
+	b := &EventBus{
+		db:      db,
+		logger:  logger,
+		seq:     seq,
+		written: seq,
+		done:    make(chan struct{}),
+		subs:    make(map[*Subscription]bool),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	go b.run()
+	return b, nil
+}
+
+// Publish assigns the next sequence number to an event of type typ for job
+// and queues it to be recorded and delivered. message returns the JSON
+// message sent to clients for the sequence number.
+func (b *EventBus) Publish(typ string, job *services.ConvertJob, message func(seq uint64) any) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		b.logger.Warn("event published after the event bus closed", "type", typ, "job_id", job.ID)
+		return
+	}
+	b.seq++
+	e := &pendingEvent{Event: Event{
+		Seq:   b.seq,
+		Type:  typ,
+		JobID: job.ID,
+		Owner: job.Owner,
+	}}
+	b.pending = append(b.pending, e)
+	b.mu.Unlock()
+
+	data, err := json.Marshal(message(e.Seq))
+	if err != nil {
+		// The writer skips the event, leaving a gap in the sequence
+		b.logger.Error("failed to marshal event message", "error", err, "type", typ)
+	}
+
+	b.mu.Lock()
+	e.Data = data
+	e.ready = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// run records and delivers the pending events in sequence order until the bus
+// is closed and every pending event is written.
+func (b *EventBus) run() {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		for (len(b.pending) == 0 || !b.pending[0].ready) && !(b.closed && len(b.pending) == 0) {
+			b.cond.Wait()
+		}
+		if len(b.pending) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		n := 0
+		for n < len(b.pending) && b.pending[n].ready {
+			n++
+		}
+		batch := b.pending[:n:n]
+		b.pending = b.pending[n:]
+		b.mu.Unlock()
+
+		for _, e := range batch {
+			if e.Data != nil {
+				b.write(e.Event)
+			}
+		}
+
+		b.mu.Lock()
+		b.written = batch[n-1].Seq
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// write records e and delivers it to the matching subscriptions.
+func (b *EventBus) write(e Event) {
+	// Clients still get the event when it cannot be recorded, they only
+	// cannot resume from it
+	err := b.db.CreateJobEvent(&services.JobEvent{
+		Seq:       e.Seq,
+		Type:      e.Type,
+		JobID:     e.JobID,
+		Owner:     e.Owner,
+		Message:   e.Data,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		b.logger.Error("failed to record job event",
+			"error", err,
+			"seq", e.Seq,
+			"job_id", e.JobID,
+		)
+	}
+
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for sub := range b.subs {
+		if !sub.filter(e) {
+			continue
+		}
+		if sub.lossless {
+			sub.C <- e
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+			// Too slow; the client reconnects and resumes from its last event
+			delete(b.subs, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// Flush waits until the events published so far are recorded and delivered.
+func (b *EventBus) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seq := b.seq
+	for b.written < seq {
+		b.cond.Wait()
+	}
+}
+
+// Close writes the pending events, stops the writer and ends the remaining
+// subscriptions. Events published afterwards are dropped.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	<-b.done
+
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.C)
+	}
+}
+
+// Subscribe registers a subscription for the events matching filter.
+func (b *EventBus) Subscribe(filter func(Event) bool) *Subscription {
+	sub := &Subscription{
+		C:      make(chan Event, streamBufferSize),
+		filter: filter,
+	}
+	b.subsMu.Lock()
+	b.subs[sub] = true
+	b.subsMu.Unlock()
+	return sub
+}
+
+// subscribeLossless registers a subscription that receives every matching
+// event; its reader must keep up, since delivery waits for it.
+func (b *EventBus) subscribeLossless(filter func(Event) bool) *Subscription {
+	sub := &Subscription{
+		C:        make(chan Event, streamBufferSize),
+		filter:   filter,
+		lossless: true,
+	}
+	b.subsMu.Lock()
+	b.subs[sub] = true
+	b.subsMu.Unlock()
+	return sub
+}
+
+// Unsubscribe ends a subscription.
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.C)
+	}
+}
+
+// eventQuery returns the query for the recorded events key may see, limited
+// to jobID if set.
+func eventQuery(key *services.APIKey, jobID string) services.EventQuery {
+	query := services.EventQuery{JobID: jobID}
+	if key.Role != RoleAdmin {
+		query.Owner = key.ID
+	}
+	return query
+}
+
+// matchesQuery reports whether e is selected by query, ignoring After.
+func matchesQuery(query services.EventQuery, e Event) bool {
+	return (query.Owner == "" || e.Owner == query.Owner) &&
+		(query.JobID == "" || e.JobID == query.JobID)
+}
+
+// replayEvents passes the recorded events selected by query and filter to send
+// in order, until send fails. It returns the sequence number of the last
+// event read; live events up to it were replayed already.
+func (s *Server) replayEvents(query services.EventQuery, filter func(Event) bool, send func(Event) bool) (uint64, error) {
+	query.Limit = replayPageSize
+	for {
+		events, err := s.db.GetJobEvents(query)
+		if err != nil {
+			return query.After, err
+		}
+		for _, record := range events {
+			query.After = record.Seq
+			e := eventFromRecord(record)
+			if filter(e) && !send(e) {
+				return query.After, nil
+			}
+		}
+		if len(events) < replayPageSize {
+			return query.After, nil
+		}
+	}
+}
+
+// wantsEventStream reports whether r asks for Server-Sent Events rather than
+// a JSON list of events.
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := eventQuery(caller(r), "")
+	if wantsEventStream(r) {
+		s.streamEvents(w, r, query)
+		return
+	}
+	s.listEvents(w, r, query)
+}
+
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	key := caller(r)
+	job, err := s.db.GetJob(id)
+	if err != nil || !canAccess(key, job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	query := eventQuery(key, id)
+	if wantsEventStream(r) {
+		s.streamEvents(w, r, query)
+		return
+	}
+	s.listEvents(w, r, query)
+}
+
+// EventsResponse is a page of recorded job events.
+type EventsResponse struct {
+	Events []*services.JobEvent `json:"events"`
+	// LastSeq is the after parameter requesting the following events
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// listEvents responds with the recorded events selected by query that follow
+// the after parameter. When after is set and no such event exists yet, it
+// waits up to the wait parameter, in seconds, for one.
+func (s *Server) listEvents(w http.ResponseWriter, r *http.Request, query services.EventQuery) {
+	params := r.URL.Query()
+
+	var err error
+	if after := params.Get("after"); after != "" {
+		if query.After, err = strconv.ParseUint(after, 10, 64); err != nil {
+			http.Error(w, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query.Limit = DefaultEventLimit
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxEventLimit {
+			http.Error(w, fmt.Sprintf("Limit must be between 1 and %d", MaxEventLimit), http.StatusBadRequest)
+			return
+		}
+		query.Limit = n
+	}
+
+	wait := time.Duration(0)
+	if params.Has("after") {
+		wait = DefaultEventWait
+	}
+	if value := params.Get("wait"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || time.Duration(n)*time.Second > MaxEventWait {
+			http.Error(w, fmt.Sprintf("Wait must be between 0 and %d seconds", int(MaxEventWait.Seconds())), http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(n) * time.Second
+	}
+
+	events, err := s.db.GetJobEvents(query)
+	if err == nil && len(events) == 0 && wait > 0 {
+		events, err = s.waitForEvents(w, r, query, wait)
+	}
+	if err != nil {
+		s.logger.Error("failed to get job events", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := EventsResponse{Events: events, LastSeq: query.After}
+	if len(events) > 0 {
+		response.LastSeq = events[len(events)-1].Seq
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// waitForEvents waits up to wait for an event selected by query and returns
+// the recorded events then, possibly none.
+func (s *Server) waitForEvents(w http.ResponseWriter, r *http.Request, query services.EventQuery, wait time.Duration) ([]*services.JobEvent, error) {
+	// The wait may outlast the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(wait + 10*time.Second)); err != nil {
+		s.logger.Warn("failed to extend write deadline", "error", err, "path", r.URL.Path)
+	}
+
+	sub := s.events.Subscribe(func(e Event) bool {
+		return e.Seq > query.After && matchesQuery(query, e)
+	})
+	defer s.events.Unsubscribe(sub)
+
+	// An event may have been published before subscribing
+	events, err := s.db.GetJobEvents(query)
+	if err != nil || len(events) > 0 {
+		return events, err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-sub.C:
+	case <-timer.C:
+	case <-r.Context().Done():
+	case <-s.closeStreams:
+	}
+	return s.db.GetJobEvents(query)
+}
+
+// streamEvents sends the events selected by query as text/event-stream until
+// the client disconnects or the server shuts down. Clients resume after the
+// event named by the Last-Event-ID header, or the last_event_id query
+// parameter for the first connection of an EventSource.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, query services.EventQuery) {
+	rc := http.NewResponseController(w)
+
+	// Streams outlive the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		s.logger.Warn("failed to clear write deadline", "error", err, "path", r.URL.Path)
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	filter := func(e Event) bool {
+		return matchesQuery(query, e)
+	}
+	sub := s.events.Subscribe(filter)
+	defer s.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+
+	// Unknown IDs resume nothing
+	var replayed uint64
+	if after, err := strconv.ParseUint(lastID, 10, 64); err == nil {
+		query.After = after
+		ok := true
+		replayed, err = s.replayEvents(query, filter, func(e Event) bool {
+			ok = writeStreamEvent(w, e)
+			return ok
+		})
+		if err != nil {
+			s.logger.Error("failed to replay job events", "error", err)
+		}
+		if !ok {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closeStreams:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				s.logger.Warn("event stream fell behind, closing", "path", r.URL.Path)
+				return
+			}
+			if e.Seq <= replayed {
+				continue
+			}
+			if !writeStreamEvent(w, e) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes e in the text/event-stream format.
+func writeStreamEvent(w http.ResponseWriter, e Event) bool {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, e.Data)
+	return err == nil
+}
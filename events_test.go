@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"document-converter/services"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// getEvents returns the page of recorded events at path.
+func (ts *testServer) getEvents(t *testing.T, path string) EventsResponse {
+	t.Helper()
+	resp := ts.do(t, http.MethodGet, path, nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	var page EventsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding events: %v", err)
+	}
+	return page
+}
+
+// eventStatus returns the job status carried by a job_update message.
+func eventStatus(t *testing.T, message []byte) string {
+	t.Helper()
+	var update WebSocketMessage
+	if err := json.Unmarshal(message, &update); err != nil {
+		t.Fatalf("decoding event message %s: %v", message, err)
+	}
+	if update.Payload == nil || update.Payload.ConvertJob == nil {
+		t.Fatalf("event message %s carries no job", message)
+	}
+	return update.Payload.Status
+}
+
+func TestEventsRecordJobUpdates(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+	ts.events.Flush()
+
+	page := ts.getEvents(t, "/events")
+	var statuses []string
+	var last uint64
+	for _, e := range page.Events {
+		if e.Seq <= last {
+			t.Errorf("seq %d follows %d", e.Seq, last)
+		}
+		last = e.Seq
+		if e.Type != EventJobUpdate || e.JobID != id {
+			t.Errorf("event %d = %s of %s, want %s of %s", e.Seq, e.Type, e.JobID, EventJobUpdate, id)
+		}
+		statuses = append(statuses, eventStatus(t, e.Message))
+	}
+
+	want := []string{StatusQueued, StatusProcessing, StatusComplete}
+	if strings.Join(statuses, ",") != strings.Join(want, ",") {
+		t.Errorf("recorded statuses = %v, want %v", statuses, want)
+	}
+	if page.LastSeq != last {
+		t.Errorf("last_seq = %d, want %d", page.LastSeq, last)
+	}
+}
+
+func TestJobEventsHistory(t *testing.T) {
+	ts := newTestServer(t)
+	first := ts.upload(t, "first.docx", makeDocx(t, "first"), "pdf")
+	second := ts.upload(t, "second.docx", makeDocx(t, "second"), "pdf")
+	ts.work(t)
+	ts.events.Flush()
+
+	page := ts.getEvents(t, "/converts/"+first+"/events")
+	if len(page.Events) != 3 {
+		t.Fatalf("got %d events of the first job, want queued, processing and complete", len(page.Events))
+	}
+	for _, e := range page.Events {
+		if e.JobID != first {
+			t.Errorf("events of %s include event %d of %s", first, e.Seq, e.JobID)
+		}
+	}
+
+	page = ts.getEvents(t, "/converts/"+second+"/events")
+	if len(page.Events) != 1 || eventStatus(t, page.Events[0].Message) != StatusQueued {
+		t.Errorf("events of the second job = %+v, want only queued", page.Events)
+	}
+}
+
+func TestEventsLongPoll(t *testing.T) {
+	ts := newTestServer(t)
+	ts.upload(t, "first.docx", makeDocx(t, "first"), "pdf")
+	ts.events.Flush()
+	after := ts.getEvents(t, "/events").LastSeq
+
+	pages := make(chan EventsResponse, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/events?after=%d&wait=10", ts.http.URL, after), nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Errorf("long poll: %v", err)
+			close(pages)
+			return
+		}
+		defer resp.Body.Close()
+		var page EventsResponse
+		json.NewDecoder(resp.Body).Decode(&page)
+		pages <- page
+	}()
+
+	// Give the request time to start waiting
+	time.Sleep(100 * time.Millisecond)
+	id := ts.upload(t, "second.docx", makeDocx(t, "second"), "pdf")
+
+	select {
+	case page := <-pages:
+		if len(page.Events) != 1 || page.Events[0].JobID != id || page.Events[0].Seq != after+1 {
+			t.Errorf("long poll returned %+v, want event %d of %s", page.Events, after+1, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll did not return the new event")
+	}
+}
+
+func TestEventsLongPollTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.events.Flush()
+	after := ts.getEvents(t, "/events").LastSeq
+
+	start := time.Now()
+	page := ts.getEvents(t, fmt.Sprintf("/events?after=%d&wait=1", after))
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("long poll returned after %s, want about 1s", elapsed)
+	}
+	if len(page.Events) != 0 || page.LastSeq != after {
+		t.Errorf("long poll = %+v, want no events and last_seq %d", page, after)
+	}
+}
+
+func TestEventBusSeqAfterRestart(t *testing.T) {
+	ts := newTestServer(t)
+	ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.events.Close()
+	last := ts.getEvents(t, "/events").LastSeq
+	if last == 0 {
+		t.Fatal("no event recorded before the restart")
+	}
+
+	// Pruned events still count
+	if err := ts.db.DeleteJobEventsBefore(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := NewEventBus(ts.db, ts.logger)
+	if err != nil {
+		t.Fatalf("NewEventBus: %v", err)
+	}
+	ts.events = events
+	t.Cleanup(events.Close)
+
+	id := ts.upload(t, "second.docx", makeDocx(t, "second"), "pdf")
+	events.Flush()
+	page := ts.getEvents(t, "/events")
+	if len(page.Events) != 1 || page.Events[0].JobID != id || page.Events[0].Seq != last+1 {
+		t.Errorf("events after restart = %+v, want event %d of %s", page.Events, last+1, id)
+	}
+}
+
+func TestRecoverJobsRecordsInterruptedJob(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	job, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing)
+	if err != nil {
+		t.Fatalf("ClaimNextJob: %v", err)
+	}
+	if err := os.Remove(ts.originalPath(job)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.recoverJobs(); err != nil {
+		t.Fatalf("recoverJobs: %v", err)
+	}
+	ts.events.Flush()
+
+	page := ts.getEvents(t, "/converts/"+id+"/events")
+	if len(page.Events) == 0 {
+		t.Fatal("no events recorded")
+	}
+	var update WebSocketMessage
+	if err := json.Unmarshal(page.Events[len(page.Events)-1].Message, &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Payload.Status != StatusFailed || update.Payload.ErrorCode != ErrorCodeInterrupted {
+		t.Errorf("last event = %s with %q, want %s with %q", update.Payload.Status, update.Payload.ErrorCode, StatusFailed, ErrorCodeInterrupted)
+	}
+}
+
+func TestDeleteJobRemovesEvents(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+	ts.events.Flush()
+
+	if resp := ts.do(t, http.MethodDelete, "/converts/"+id, nil, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /converts/%s: status %d", id, resp.StatusCode)
+	}
+	ts.events.Flush()
+
+	events, err := ts.db.GetJobEvents(services.EventQuery{JobID: id, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EventJobDelete {
+		t.Errorf("events left of the deleted job = %+v, want only its %s", events, EventJobDelete)
+	}
+	if resp := ts.do(t, http.MethodGet, "/converts/"+id+"/events", nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /converts/%s/events: status %d, want 404", id, resp.StatusCode)
+	}
+}
+
+func TestWebSocketResume(t *testing.T) {
+	ts := newTestServer(t)
+	go ts.runWebSocketHub()
+
+	ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+	ts.events.Flush()
+	page := ts.getEvents(t, "/events")
+	if len(page.Events) != 3 {
+		t.Fatalf("got %d events, want 3", len(page.Events))
+	}
+	after := page.Events[0].Seq
+
+	url := "ws" + strings.TrimPrefix(ts.http.URL, "http") + fmt.Sprintf("/ws?after=%d", after)
+	header := http.Header{"Authorization": {"Bearer " + testAPIKey}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	readSeq := func() uint64 {
+		t.Helper()
+		var message WebSocketMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("reading websocket message: %v", err)
+		}
+		return message.Seq
+	}
+
+	// The missed events, then live ones
+	for want := after + 1; want <= page.LastSeq; want++ {
+		if seq := readSeq(); seq != want {
+			t.Fatalf("replayed seq %d, want %d", seq, want)
+		}
+	}
+	ts.upload(t, "second.docx", makeDocx(t, "second"), "pdf")
+	if seq := readSeq(); seq != page.LastSeq+1 {
+		t.Errorf("live seq %d, want %d", seq, page.LastSeq+1)
+	}
+}
+
+// streamEvent is an event read from a text/event-stream response.
+type streamEvent struct {
+	id   uint64
+	typ  string
+	data string
+}
+
+// openStream requests path as Server-Sent Events with the given header.
+func (ts *testServer) openStream(t *testing.T, path string, header http.Header) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.http.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+ts.key)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+// readStreamEvent returns the next event of a stream, skipping comments and
+// the retry field.
+func readStreamEvent(t *testing.T, r *bufio.Reader) streamEvent {
+	t.Helper()
+	var e streamEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			e.id, _ = strconv.ParseUint(value, 10, 64)
+		case "event":
+			e.typ = value
+		case "data":
+			e.data = value
+		case "":
+			if e.id != 0 {
+				return e
+			}
+		}
+	}
+}
+
+// publishTestEvent publishes a job_update of a job that need not exist.
+func (ts *testServer) publishTestEvent(jobID string) {
+	job := &services.ConvertJob{ID: jobID, Owner: bootstrapKeyID, Status: StatusQueued}
+	ts.broadcastJobUpdate(job)
+}
+
+func TestStreamEventsResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		header func(seq uint64) http.Header
+		query  func(seq uint64) string
+	}{
+		{
+			name:   "Last-Event-ID",
+			header: func(seq uint64) http.Header { return http.Header{"Last-Event-ID": {strconv.FormatUint(seq, 10)}} },
+			query:  func(uint64) string { return "" },
+		},
+		{
+			name:   "last_event_id",
+			header: func(uint64) http.Header { return nil },
+			query:  func(seq uint64) string { return fmt.Sprintf("?last_event_id=%d", seq) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+			ts.work(t)
+			ts.events.Flush()
+			page := ts.getEvents(t, "/events")
+			after := page.Events[0].Seq
+
+			stream := ts.openStream(t, "/events"+tt.query(after), tt.header(after))
+			for want := after + 1; want <= page.LastSeq; want++ {
+				e := readStreamEvent(t, stream)
+				if e.id != want || e.typ != EventJobUpdate {
+					t.Fatalf("replayed %s %d, want %s %d", e.typ, e.id, EventJobUpdate, want)
+				}
+			}
+
+			id := ts.upload(t, "second.docx", makeDocx(t, "second"), "pdf")
+			e := readStreamEvent(t, stream)
+			if e.id != page.LastSeq+1 || !strings.Contains(e.data, id) {
+				t.Errorf("live event %d %s, want %d of %s", e.id, e.data, page.LastSeq+1, id)
+			}
+		})
+	}
+}
+
+func TestStreamEventsReplayThenLiveWithoutDuplicates(t *testing.T) {
+	ts := newTestServer(t)
+	const recorded, live = 30, 30
+	for i := 0; i < recorded; i++ {
+		ts.publishTestEvent(fmt.Sprintf("recorded-%d", i))
+	}
+	ts.events.Flush()
+
+	// Publish while the stream subscribes and replays, so that events are
+	// both replayed and queued live
+	go func() {
+		for i := 0; i < live; i++ {
+			ts.publishTestEvent(fmt.Sprintf("live-%d", i))
+		}
+	}()
+	stream := ts.openStream(t, "/events", http.Header{"Last-Event-ID": {"0"}})
+
+	for want := uint64(1); want <= recorded+live; want++ {
+		if e := readStreamEvent(t, stream); e.id != want {
+			t.Fatalf("stream sent event %d, want %d", e.id, want)
+		}
+	}
+}
+
+func TestStreamJobEvents(t *testing.T) {
+	ts := newTestServer(t)
+	first := ts.upload(t, "first.docx", makeDocx(t, "first"), "pdf")
+	second := ts.upload(t, "second.docx", makeDocx(t, "second"), "pdf")
+	ts.events.Flush()
+
+	stream := ts.openStream(t, "/converts/"+first+"/events?last_event_id=0", nil)
+	if e := readStreamEvent(t, stream); !strings.Contains(e.data, first) || eventStatus(t, []byte(e.data)) != StatusQueued {
+		t.Fatalf("first event %s, want %s queued", e.data, first)
+	}
+
+	// Events of the second job are left out, the first job's delete is not
+	ts.work(t)
+	ts.work(t)
+	for _, want := range []string{StatusProcessing, StatusComplete} {
+		e := readStreamEvent(t, stream)
+		if !strings.Contains(e.data, first) || strings.Contains(e.data, second) || eventStatus(t, []byte(e.data)) != want {
+			t.Fatalf("event %s, want %s %s", e.data, first, want)
+		}
+	}
+	if resp := ts.do(t, http.MethodDelete, "/converts/"+first, nil, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /converts/%s: status %d", first, resp.StatusCode)
+	}
+	if e := readStreamEvent(t, stream); e.typ != EventJobDelete || !strings.Contains(e.data, first) {
+		t.Errorf("event %s %s, want %s of %s", e.typ, e.data, EventJobDelete, first)
+	}
+}
+
+func TestSubscriptionFallingBehindIsClosed(t *testing.T) {
+	ts := newTestServer(t)
+	sub := ts.events.Subscribe(func(Event) bool { return true })
+
+	for i := 0; i < streamBufferSize+1; i++ {
+		ts.publishTestEvent(fmt.Sprintf("job-%d", i))
+	}
+	ts.events.Flush()
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	if received != streamBufferSize {
+		t.Errorf("received %d events before the subscription closed, want %d", received, streamBufferSize)
+	}
+	// Unsubscribing a dropped subscription is harmless
+	ts.events.Unsubscribe(sub)
+}
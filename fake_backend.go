@@ -0,0 +1,77 @@
+// fake_backend.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeBackend is a deterministic Backend that does not need LibreOffice.
+// The output file content depends only on the input bytes and target format,
+// which makes it suitable for end-to-end tests of the HTTP API.
+type FakeBackend struct {
+	// Delay is waited before producing output; the wait honours ctx.
+	Delay time.Duration
+	// Err, when set, is returned instead of producing output.
+	Err error
+
+	mu    sync.Mutex
+	calls []ConvertOptions
+}
+
+func (b *FakeBackend) Convert(ctx context.Context, input, outputDir string, opts ConvertOptions) ([]Artifact, error) {
+	b.mu.Lock()
+	b.calls = append(b.calls, opts)
+	b.mu.Unlock()
+
+	if b.Delay > 0 {
+		timer := time.NewTimer(b.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, &ConversionError{
+				Code:    ErrorCodeConversionFailed,
+				Message: "Conversion interrupted",
+				Err:     ctx.Err(),
+			}
+		case <-timer.C:
+		}
+	}
+
+	if b.Err != nil {
+		return nil, &ConversionError{
+			Code:    ErrorCodeConversionFailed,
+			Message: b.Err.Error(),
+			Err:     b.Err,
+		}
+	}
+
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return nil, err
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	convertedFile := filepath.Join(outputDir, baseName+opts.Format.Extension)
+	content := fmt.Sprintf("fake %s conversion of %s (%d bytes, sha256 %x)\n",
+		opts.Format.Name, filepath.Base(input), len(data), sha256.Sum256(data))
+
+	if err := os.WriteFile(convertedFile, []byte(content), 0644); err != nil {
+		return nil, err
+	}
+
+	return []Artifact{{Path: convertedFile, MimeType: opts.Format.MimeType}}, nil
+}
+
+// Calls returns the options of every Convert call made so far.
+func (b *FakeBackend) Calls() []ConvertOptions {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]ConvertOptions(nil), b.calls...)
+}
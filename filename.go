@@ -0,0 +1,126 @@
+// filename.go
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// storedInputName is the base name uploads are stored under in the job
+// directory; client file names are only kept for display.
+const storedInputName = "input"
+
+// maxFilenameBytes bounds the length of sanitized display names.
+const maxFilenameBytes = 255
+
+// defaultFilename replaces display names that are empty after sanitizing.
+const defaultFilename = "document"
+
+// reservedFilenames are device names Windows refuses as file names, with or
+// without an extension.
+var reservedFilenames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename turns a client-supplied file name into a display name that
+// is safe to log, store and send back in headers. Directory components,
+// control and invisible formatting characters and characters reserved on
+// common file systems are removed, and reserved device names are prefixed.
+func sanitizeFilename(name string) string {
+	// Browsers on Windows may send a full path
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range strings.ToValidUTF8(name, "") {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			continue
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.Trim(b.String(), " .")
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		stem = defaultFilename
+	}
+	if reservedFilenames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		stem = "_" + stem
+	}
+
+	// Shorten the stem, not the extension, and keep runes intact
+	for len(stem)+len(ext) > maxFilenameBytes && len(stem) > 0 {
+		_, size := utf8.DecodeLastRuneInString(stem)
+		stem = stem[:len(stem)-size]
+	}
+	if len(stem)+len(ext) > maxFilenameBytes {
+		return defaultFilename
+	}
+
+	return stem + ext
+}
+
+// contentDisposition builds an attachment Content-Disposition header for name
+// per RFC 6266: a quoted ASCII fallback for old clients plus the UTF-8 name
+// encoded per RFC 5987 when it is not plain ASCII.
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	ascii := true
+	for _, r := range name {
+		switch {
+		case r >= utf8.RuneSelf || r < 0x20 || r == 0x7f:
+			ascii = false
+			fallback.WriteRune('_')
+		case r == '"' || r == '\\':
+			fallback.WriteRune('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+
+	header := fmt.Sprintf(`attachment; filename="%s"`, fallback.String())
+	if !ascii {
+		header += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return header
+}
+
+// encodeRFC5987 percent-encodes every byte of value outside the RFC 5987
+// attr-char set.
+func encodeRFC5987(value string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
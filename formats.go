@@ -0,0 +1,139 @@
+// formats.go
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// InputFormat describes an accepted upload type.
+type InputFormat struct {
+	// Extension of uploaded files, including the dot
+	Extension string
+	// MimeType is the type content sniffing must detect for such files
+	MimeType string
+	// Zip marks ZIP based packages, which are validated before conversion
+	Zip bool
+}
+
+var inputFormats = map[string]InputFormat{
+	".docx": {
+		Extension: ".docx",
+		MimeType:  "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		Zip:       true,
+	},
+	".xlsx": {
+		Extension: ".xlsx",
+		MimeType:  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Zip:       true,
+	},
+	".odt": {
+		Extension: ".odt",
+		MimeType:  "application/vnd.oasis.opendocument.text",
+		Zip:       true,
+	},
+}
+
+// inputExtensions returns the accepted upload extensions in a stable order.
+func inputExtensions() []string {
+	exts := make([]string, 0, len(inputFormats))
+	for ext := range inputFormats {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// DefaultTargetFormat is used when a conversion request does not name one.
+const DefaultTargetFormat = "html"
+
+// OutputFormat describes a conversion target supported by LibreOffice.
+type OutputFormat struct {
+	// Name is the value accepted in the target_format form field
+	Name string
+	// Filter is passed to libreoffice --convert-to
+	Filter string
+	// Extension of the file LibreOffice produces, including the dot
+	Extension string
+	// MimeType is served as Content-Type on download
+	MimeType string
+	// Inputs restricts the format to these input extensions; empty means any
+	Inputs []string
+}
+
+var outputFormats = map[string]OutputFormat{
+	"html": {
+		Name:      "html",
+		Filter:    "html:HTML:EmbedImages",
+		Extension: ".html",
+		MimeType:  "text/html; charset=utf-8",
+	},
+	"pdf": {
+		Name:      "pdf",
+		Filter:    "pdf",
+		Extension: ".pdf",
+		MimeType:  "application/pdf",
+	},
+	"markdown": {
+		Name:      "markdown",
+		Filter:    "md:Markdown",
+		Extension: ".md",
+		MimeType:  "text/markdown; charset=utf-8",
+		Inputs:    []string{".docx", ".odt"},
+	},
+	"txt": {
+		Name:      "txt",
+		Filter:    "txt:Text (encoded):UTF8",
+		Extension: ".txt",
+		MimeType:  "text/plain; charset=utf-8",
+		Inputs:    []string{".docx", ".odt"},
+	},
+	"odt": {
+		Name:      "odt",
+		Filter:    "odt:writer8",
+		Extension: ".odt",
+		MimeType:  "application/vnd.oasis.opendocument.text",
+		Inputs:    []string{".docx", ".odt"},
+	},
+	"csv": {
+		Name:      "csv",
+		Filter:    "csv:Text - txt - csv (StarCalc):44,34,76,1",
+		Extension: ".csv",
+		MimeType:  "text/csv; charset=utf-8",
+		Inputs:    []string{".xlsx"},
+	},
+}
+
+// lookupOutputFormat returns the registered format for name, falling back to
+// the default format when name is empty.
+func lookupOutputFormat(name string) (OutputFormat, bool) {
+	if name == "" {
+		name = DefaultTargetFormat
+	}
+	format, ok := outputFormats[strings.ToLower(name)]
+	return format, ok
+}
+
+// AcceptsInput reports whether files with the given extension can be
+// converted to this format.
+func (f OutputFormat) AcceptsInput(ext string) bool {
+	if len(f.Inputs) == 0 {
+		return true
+	}
+	for _, input := range f.Inputs {
+		if input == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// outputFormatNames returns the registered format names in a stable order.
+func outputFormatNames() []string {
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
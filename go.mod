@@ -6,6 +6,5 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.18
+	golang.org/x/net v0.17.0
 )
-
-require golang.org/x/net v0.17.0 // indirect
@@ -0,0 +1,93 @@
+// limits.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultMaxUploadSize is the largest upload accepted unless MAX_UPLOAD_SIZE
+// or a per-format MAX_UPLOAD_SIZE_<EXT> overrides it.
+const DefaultMaxUploadSize = 100 << 20
+
+// multipartOverhead is allowed on top of the largest upload for the
+// multipart headers and the other form fields.
+const multipartOverhead = 64 << 10
+
+// Deadlines of the routes that stream documents; other routes keep the
+// server's short read and write timeouts.
+const (
+	DefaultUploadTimeout   = 10 * time.Minute
+	DefaultDownloadTimeout = 10 * time.Minute
+)
+
+// UploadLimits caps the size of uploaded documents.
+type UploadLimits struct {
+	// MaxSize applies to input formats without their own limit
+	MaxSize int64
+	// FormatMaxSizes maps input extensions, including the dot, to limits
+	FormatMaxSizes map[string]int64
+}
+
+// loadUploadLimits reads MAX_UPLOAD_SIZE and the per-format
+// MAX_UPLOAD_SIZE_<EXT> overrides, e.g. MAX_UPLOAD_SIZE_XLSX=209715200.
+func loadUploadLimits() UploadLimits {
+	limits := UploadLimits{
+		MaxSize:        int64(envInt("MAX_UPLOAD_SIZE", DefaultMaxUploadSize)),
+		FormatMaxSizes: make(map[string]int64),
+	}
+	for ext := range inputFormats {
+		key := "MAX_UPLOAD_SIZE_" + strings.ToUpper(strings.TrimPrefix(ext, "."))
+		if size := envInt(key, 0); size > 0 {
+			limits.FormatMaxSizes[ext] = int64(size)
+		}
+	}
+	return limits
+}
+
+// forInput returns the upload limit of files with extension ext.
+func (l UploadLimits) forInput(ext string) int64 {
+	if size, ok := l.FormatMaxSizes[ext]; ok {
+		return size
+	}
+	return l.MaxSize
+}
+
+// requestLimit returns the largest request body that can carry an
+// acceptable upload.
+func (l UploadLimits) requestLimit() int64 {
+	limit := l.MaxSize
+	for _, size := range l.FormatMaxSizes {
+		limit = max(limit, size)
+	}
+	return limit + multipartOverhead
+}
+
+// isTooLarge reports whether err was caused by a request body exceeding
+// http.MaxBytesReader's limit.
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// withDeadlines replaces the server's read and write timeouts for requests to
+// next; zero durations keep the server's timeout.
+func (s *Server) withDeadlines(read, write time.Duration, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		now := time.Now()
+		if read > 0 {
+			if err := rc.SetReadDeadline(now.Add(read)); err != nil {
+				s.logger.Warn("failed to extend read deadline", "error", err, "path", r.URL.Path)
+			}
+		}
+		if write > 0 {
+			if err := rc.SetWriteDeadline(now.Add(write)); err != nil {
+				s.logger.Warn("failed to extend write deadline", "error", err, "path", r.URL.Path)
+			}
+		}
+		next(w, r)
+	})
+}
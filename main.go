@@ -3,24 +3,28 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
 	"document-converter/services"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 )
 
 var (
@@ -29,9 +33,30 @@ var (
 )
 
 const (
-	StatusPending  = "pending"
-	StatusComplete = "complete"
-	StatusFailed   = "failed"
+	StatusQueued     = "queued"
+	StatusProcessing = "processing"
+	StatusComplete   = "complete"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+	StatusRejected   = "rejected"
+)
+
+// Error codes recorded on failed jobs
+const (
+	ErrorCodeConversionFailed = "conversion_failed"
+	ErrorCodeTimeout          = "timeout"
+	ErrorCodeInternal         = "internal_error"
+	ErrorCodeInterrupted      = "interrupted"
+	ErrorCodeInfected         = "infected"
+	ErrorCodeScanFailed       = "scan_failed"
+)
+
+// Error codes of uploads rejected before they are queued
+const (
+	ErrorCodeArchiveLimit      = "archive_limit_exceeded"
+	ErrorCodeEncryptedDocument = "encrypted_document"
+	ErrorCodeMalformedDocument = "malformed_document"
+	ErrorCodeUploadTooLarge    = "upload_too_large"
 )
 
 type Link struct {
@@ -45,18 +70,6 @@ type JobResponse struct {
 	Links []Link `json:"links"`
 }
 
-type Converter struct {
-	tempDir string
-	logger  *slog.Logger
-}
-
-func NewConverter(tempDir string, logger *slog.Logger) *Converter {
-	return &Converter{
-		tempDir: tempDir,
-		logger:  logger,
-	}
-}
-
 type responseWriter struct {
 	http.ResponseWriter
 	http.Hijacker
@@ -68,6 +81,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func loggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -104,26 +122,16 @@ func loggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
 	})
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // In production, you might want to be more restrictive
-	},
-}
-
-type ClientConnection struct {
-	conn *websocket.Conn
-	mu   sync.Mutex
-}
-
 type WebSocketMessage struct {
-	Type    string               `json:"type"`
-	Payload *services.ConvertJob `json:"payload"`
+	Type string `json:"type"`
+	// Seq is the sequence number of the event, to resume from
+	Seq     uint64       `json:"seq"`
+	Payload *JobResponse `json:"payload"`
 }
 
 type WebSocketDeleteMessage struct {
 	Type  string `json:"type"`
+	Seq   uint64 `json:"seq"`
 	JobID string `json:"job_id"`
 }
 
@@ -133,6 +141,124 @@ type Server struct {
 	db        *services.DB
 	clients   map[*ClientConnection]bool
 	clientsMu sync.RWMutex
+
+	// queueSignal wakes idle workers when a job is queued
+	queueSignal chan struct{}
+
+	// running holds the cancel functions of jobs being converted
+	running   map[string]context.CancelCauseFunc
+	runningMu sync.Mutex
+
+	// shuttingDown is set once the server stops accepting conversions
+	shuttingDown atomic.Bool
+
+	// archiveLimits bounds the ZIP packages accepted for conversion
+	archiveLimits ArchiveLimits
+
+	// sanitizePolicy is applied to HTML output of jobs not naming a policy
+	sanitizePolicy string
+
+	// scanner, when set, checks every upload before it is converted
+	scanner Scanner
+
+	// uploadLimits caps the size of uploaded documents
+	uploadLimits UploadLimits
+
+	// Deadlines of the routes streaming documents
+	uploadTimeout   time.Duration
+	downloadTimeout time.Duration
+
+	// defaultQuotas apply to API keys without quotas of their own
+	defaultQuotas services.Quotas
+	// quotaMu serializes quota checks with the creation of the checked job
+	quotaMu sync.Mutex
+
+	// rateLimiter, when set, limits conversion requests per API key
+	rateLimiter *RateLimiter
+	// maxQueueDepth refuses conversions while as many jobs are queued
+	maxQueueDepth int
+
+	// webhooks delivers the callbacks of finished jobs
+	webhooks *Webhooks
+
+	// events records job updates and carries them to WebSocket clients and
+	// event streams
+	events *EventBus
+	// eventRetention is how long recorded events are kept
+	eventRetention time.Duration
+	// closeStreams is closed when the HTTP server shuts down
+	closeStreams chan struct{}
+}
+
+func NewServer(converter *Converter, db *services.DB, logger *slog.Logger) *Server {
+	return &Server{
+		converter: converter,
+		logger:    logger,
+		db:        db,
+		clients:   make(map[*ClientConnection]bool),
+
+		queueSignal: make(chan struct{}, 1),
+		running:     make(map[string]context.CancelCauseFunc),
+
+		archiveLimits:  loadArchiveLimits(),
+		sanitizePolicy: SanitizePolicyNone,
+		uploadLimits:   loadUploadLimits(),
+
+		uploadTimeout:   envDuration("UPLOAD_TIMEOUT", DefaultUploadTimeout),
+		downloadTimeout: envDuration("DOWNLOAD_TIMEOUT", DefaultDownloadTimeout),
+
+		defaultQuotas: loadDefaultQuotas(),
+		rateLimiter:   loadRateLimiter(),
+		maxQueueDepth: envInt("MAX_QUEUE_DEPTH", DefaultMaxQueueDepth),
+
+		eventRetention: envDuration("EVENT_RETENTION", DefaultEventRetention),
+		closeStreams:   make(chan struct{}),
+	}
+}
+
+// writeJSONError responds with status and a JSON body carrying a
+// machine-readable error code.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      message,
+		"error_code": code,
+	})
+}
+
+// routes returns the HTTP handler serving every endpoint of the API.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	// Both / and /panel point to the same handler
+	mux.HandleFunc("GET /", s.handlePanel)
+	mux.HandleFunc("GET /panel", s.handlePanel)
+
+	// Convert endpoints
+	mux.HandleFunc("GET /converts", s.handleListConverts)
+	mux.Handle("POST /converts", s.withDeadlines(s.uploadTimeout, s.uploadTimeout, s.admit(s.handleCreateConvert)))
+	mux.HandleFunc("GET /converts/{id}", s.handleGetConvert)
+	mux.Handle("GET /convert-outcomes/{id}", s.withDeadlines(0, s.downloadTimeout, s.handleDownloadConvert))
+	mux.HandleFunc("DELETE /converts/{id}", s.handleDeleteConvert)
+	mux.HandleFunc("POST /converts/{id}/cancel", s.handleCancelConvert)
+	mux.HandleFunc("POST /converts/{id}/retry", s.handleRetryConvert)
+	mux.HandleFunc("GET /converts/{id}/deliveries", s.handleListDeliveries)
+	mux.HandleFunc("GET /webhook-secret", s.handleGetWebhookSecret)
+	mux.HandleFunc("GET /ws", s.handleWebSocket)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("GET /converts/{id}/events", s.handleJobEvents)
+	mux.HandleFunc("GET /usage", s.handleUsage)
+
+	// API key management
+	mux.HandleFunc("GET /api-keys", requireAdmin(s.handleListAPIKeys))
+	mux.HandleFunc("POST /api-keys", requireAdmin(s.handleCreateAPIKey))
+	mux.HandleFunc("DELETE /api-keys/{id}", requireAdmin(s.handleDeleteAPIKey))
+	mux.HandleFunc("PUT /api-keys/{id}/quotas", requireAdmin(s.handleUpdateAPIKeyQuotas))
+
+	// Wrap all handlers with authentication and logging middleware
+	return loggingMiddleware(s.logger, s.authMiddleware(mux))
 }
 
 func (s *Server) handlePanel(w http.ResponseWriter, r *http.Request) {
@@ -144,8 +270,13 @@ func (s *Server) handlePanel(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleListConverts(w http.ResponseWriter, r *http.Request) {
-
-	jobs, err := s.db.GetAllJobs()
+	var jobs []*services.ConvertJob
+	var err error
+	if key := caller(r); key.Role == RoleAdmin {
+		jobs, err = s.db.GetAllJobs()
+	} else {
+		jobs, err = s.db.GetOwnerJobs(key.ID)
+	}
 	if err != nil {
 		s.logger.Error("failed to get jobs", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -165,6 +296,10 @@ func (s *Server) handleDownloadConvert(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
+	if !canAccess(caller(r), job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
 
 	if job.Status != StatusComplete {
 		http.Error(w, "Conversion not complete", http.StatusNotFound)
@@ -188,10 +323,22 @@ func (s *Server) handleDownloadConvert(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	format, ok := lookupOutputFormat(job.TargetFormat)
+	if !ok {
+		s.logger.Error("job has unknown target format",
+			"job_id", id,
+			"target_format", job.TargetFormat,
+		)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Name the download after the uploaded file with the target extension
+	baseName := strings.TrimSuffix(job.OriginalFile, filepath.Ext(job.OriginalFile))
+
 	// Set appropriate headers
-	w.Header().Set("Content-Type", "text/html")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s",
-		filepath.Base(job.ConvertedFile)))
+	w.Header().Set("Content-Type", format.MimeType)
+	w.Header().Set("Content-Disposition", contentDisposition(sanitizeFilename(baseName+format.Extension)))
 
 	// Stream the file
 	if _, err := io.Copy(w, file); err != nil {
@@ -210,43 +357,61 @@ func (s *Server) handleGetConvert(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
+	if !canAccess(caller(r), job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
 
 	// Create response with links
 	response := JobResponse{
 		ConvertJob: job,
-		Links: []Link{
-			{
-				Href:   fmt.Sprintf("/converts/%s", job.ID),
-				Rel:    "self",
-				Method: "GET",
-			},
+		Links:      jobLinks(job),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// jobLinks returns the links of a job's resources.
+func jobLinks(job *services.ConvertJob) []Link {
+	links := []Link{
+		{
+			Href:   fmt.Sprintf("/converts/%s", job.ID),
+			Rel:    "self",
+			Method: "GET",
 		},
 	}
 
 	// Add download link only if conversion is complete
 	if job.Status == StatusComplete && job.ConvertedFile != "" {
-		response.Links = append(response.Links, Link{
+		links = append(links, Link{
 			Href:   fmt.Sprintf("/convert-outcomes/%s", job.ID),
 			Rel:    "download",
 			Method: "GET",
 		})
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return links
 }
 
 func (s *Server) handleCreateConvert(w http.ResponseWriter, r *http.Request) {
 	s.logger.Info("starting new conversion request")
 
-	// Define allowed file extensions
-	allowedExtensions := map[string]bool{
-		".docx": true,
-		".xlsx": true,
-		".odt":  true,
+	if s.shuttingDown.Load() {
+		w.Header().Set("Retry-After", shutdownRetryAfter)
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, s.uploadLimits.requestLimit())
 	file, header, err := r.FormFile("file")
+	if isTooLarge(err) {
+		s.logger.Warn("upload exceeds the request size limit",
+			"limit", s.uploadLimits.requestLimit(),
+		)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, ErrorCodeUploadTooLarge,
+			fmt.Sprintf("Upload exceeds the limit of %d bytes", s.uploadLimits.MaxSize))
+		return
+	}
 	if err != nil {
 		s.logger.Error("no file provided in request",
 			"error", err,
@@ -257,160 +422,320 @@ func (s *Server) handleCreateConvert(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file extension
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	if !allowedExtensions[ext] {
+	// The client's file name is only used for display and downloads
+	filename := sanitizeFilename(header.Filename)
+
+	// Validate file extension; the content is checked once staged
+	ext := strings.ToLower(filepath.Ext(filename))
+	input, ok := inputFormats[ext]
+	if !ok {
 		s.logger.Error("invalid file extension",
-			"filename", header.Filename,
+			"filename", filename,
 			"extension", ext,
 		)
-		http.Error(w, "Invalid file type. Allowed types: .docx, .xlsx, .odt", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid file type. Allowed types: %s",
+			strings.Join(inputExtensions(), ", ")), http.StatusBadRequest)
+		return
+	}
+
+	if limit := s.uploadLimits.forInput(ext); header.Size > limit {
+		s.logger.Warn("upload exceeds the size limit of its format",
+			"filename", filename,
+			"size", header.Size,
+			"limit", limit,
+		)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, ErrorCodeUploadTooLarge,
+			fmt.Sprintf("%s uploads are limited to %d bytes", ext, limit))
+		return
+	}
+	if quotaErr := s.checkFileSize(caller(r), header.Size); quotaErr != nil {
+		quotaErr.write(w)
 		return
 	}
 
-	// Validate Content-Type
-	allowedMimeTypes := map[string]bool{
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": true,
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       true,
-		"application/vnd.oasis.opendocument.text":                                 true,
+	// Validate requested output format
+	format, ok := lookupOutputFormat(r.FormValue("target_format"))
+	if !ok {
+		s.logger.Error("invalid target format",
+			"filename", filename,
+			"target_format", r.FormValue("target_format"),
+		)
+		http.Error(w, fmt.Sprintf("Invalid target format. Allowed formats: %s",
+			strings.Join(outputFormatNames(), ", ")), http.StatusBadRequest)
+		return
 	}
 
-	contentType := header.Header.Get("Content-Type")
-	if !allowedMimeTypes[contentType] {
-		s.logger.Error("invalid content type",
-			"filename", header.Filename,
-			"content_type", contentType,
+	if !format.AcceptsInput(ext) {
+		s.logger.Error("target format does not support input type",
+			"filename", filename,
+			"extension", ext,
+			"target_format", format.Name,
 		)
-		http.Error(w, "Invalid file type", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Cannot convert %s files to %s", ext, format.Name), http.StatusBadRequest)
 		return
 	}
 
+	// Sanitizing only applies to HTML output
+	policyName := r.FormValue("sanitize_policy")
+	if _, ok := lookupSanitizePolicy(policyName); policyName != "" && !ok {
+		http.Error(w, fmt.Sprintf("Invalid sanitize policy. Allowed policies: %s",
+			strings.Join(sanitizePolicyNames(), ", ")), http.StatusBadRequest)
+		return
+	}
+	if format.Name != "html" {
+		if policyName != "" && !strings.EqualFold(policyName, SanitizePolicyNone) {
+			http.Error(w, "sanitize_policy only applies to html output", http.StatusBadRequest)
+			return
+		}
+		policyName = ""
+	} else if policyName == "" {
+		policyName = s.sanitizePolicy
+	}
+	policyName = strings.ToLower(policyName)
+
+	// Finished jobs are posted to the optional callback URL
+	callbackURL := r.FormValue("callback_url")
+	if callbackURL != "" {
+		if err := validateCallbackURL(callbackURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	s.logger.Info("received file for conversion",
-		"filename", header.Filename,
+		"filename", filename,
 		"size", header.Size,
+		"owner", caller(r).ID,
 		"content_type", header.Header.Get("Content-Type"),
+		"target_format", format.Name,
 	)
 
 	jobID := uuid.New().String()
 
+	// Create job directory structure
+	jobDir := filepath.Join(s.converter.tempDir, jobID)
+	originalDir := filepath.Join(jobDir, "original")
+	convertedDir := filepath.Join(jobDir, "converted")
+
+	// Create directories
+	for _, dir := range []string{originalDir, convertedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			s.logger.Error("failed to create directory",
+				"path", dir,
+				"error", err,
+				"job_id", jobID,
+			)
+			os.RemoveAll(jobDir)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Stage original file before the job becomes visible to workers
+	originalPath := filepath.Join(originalDir, storedInputName+ext)
+	size, checksum, err := stageUpload(file, originalPath)
+	if err != nil {
+		s.logger.Error("failed to stage original file",
+			"path", originalPath,
+			"error", err,
+			"job_id", jobID,
+		)
+		os.RemoveAll(jobDir)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("original file staged",
+		"job_id", jobID,
+		"path", originalPath,
+		"size", size,
+		"sha256", checksum,
+	)
+
+	// Trust the content, not the client's Content-Type or the file name
+	detectedType, err := sniffDocument(originalPath)
+	if errors.Is(err, errEncryptedDocument) {
+		os.RemoveAll(jobDir)
+		writeJSONError(w, http.StatusUnprocessableEntity, ErrorCodeEncryptedDocument, "Encrypted documents are not supported")
+		return
+	}
+	if err != nil || detectedType != input.MimeType {
+		s.logger.Error("file content does not match its extension",
+			"error", err,
+			"job_id", jobID,
+			"extension", ext,
+			"detected_type", detectedType,
+		)
+		os.RemoveAll(jobDir)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("File content is not a valid %s document", ext), http.StatusBadRequest)
+		} else {
+			http.Error(w, fmt.Sprintf("File content (%s) does not match the %s extension", detectedType, ext), http.StatusBadRequest)
+		}
+		return
+	}
+
+	// Reject packages that could exhaust LibreOffice before they are queued
+	if input.Zip {
+		if err := validateArchive(originalPath, s.archiveLimits); err != nil {
+			os.RemoveAll(jobDir)
+			archiveErr, ok := asArchiveError(err)
+			if !ok {
+				s.logger.Error("failed to validate archive",
+					"error", err,
+					"job_id", jobID,
+				)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			s.logger.Warn("rejected archive",
+				"job_id", jobID,
+				"filename", filename,
+				"code", archiveErr.Code,
+				"reason", archiveErr.Message,
+			)
+			writeJSONError(w, http.StatusUnprocessableEntity, archiveErr.Code, archiveErr.Message)
+			return
+		}
+	}
+
+	// Hold the quotas until the job counts against them
+	s.quotaMu.Lock()
+	if err := s.checkQuotas(caller(r), size); err != nil {
+		s.quotaMu.Unlock()
+		os.RemoveAll(jobDir)
+		var quotaErr *QuotaError
+		if !errors.As(err, &quotaErr) {
+			s.logger.Error("failed to check quotas",
+				"error", err,
+				"job_id", jobID,
+			)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Warn("quota exceeded",
+			"owner", caller(r).ID,
+			"code", quotaErr.Code,
+			"reason", quotaErr.Message,
+		)
+		quotaErr.write(w)
+		return
+	}
+
 	job := &services.ConvertJob{
-		ID:           jobID,
-		OriginalFile: header.Filename,
-		Status:       StatusPending,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		ID:             jobID,
+		Owner:          caller(r).ID,
+		OriginalFile:   filename,
+		OriginalPath:   originalPath,
+		SizeBytes:      size,
+		SHA256:         checksum,
+		DetectedType:   detectedType,
+		TargetFormat:   format.Name,
+		SanitizePolicy: policyName,
+		CallbackURL:    callbackURL,
+		Status:         StatusQueued,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
 	}
 
 	if err := s.db.CreateJob(job); err != nil {
+		s.quotaMu.Unlock()
 		s.logger.Error("failed to create job in database",
 			"error", err,
 			"job_id", jobID,
 		)
+		os.RemoveAll(jobDir)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if err := s.db.CountJob(job.Owner, usageDay(job.CreatedAt)); err != nil {
+		s.logger.Error("failed to count job against daily quota",
+			"error", err,
+			"job_id", jobID,
+		)
+	}
+	s.quotaMu.Unlock()
 
 	// Broadcast the initial job creation
 	s.broadcastJobUpdate(job)
 
-	s.logger.Info("conversion job created",
+	s.logger.Info("conversion job queued",
 		"job_id", jobID,
-		"filename", header.Filename,
+		"filename", filename,
 	)
 
-	// Start processing in a goroutine to not block the response
-	go s.processConversion(jobID, file, header.Filename)
+	// Wake a worker to pick up the job
+	s.notifyWorkers()
 
 	w.Header().Set("Location", fmt.Sprintf("/converts/%s", jobID))
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{"id": jobID})
 }
 
-func (s *Server) processConversion(jobID string, file io.Reader, filename string) {
+// processConversion converts a job that a worker has claimed.
+func (s *Server) processConversion(claimed *services.ConvertJob) {
+	jobID := claimed.ID
 	s.logger.Info("starting conversion process",
 		"job_id", jobID,
-		"filename", filename,
+		"filename", claimed.OriginalFile,
+		"target_format", claimed.TargetFormat,
 	)
 
-	// Get initial job state to broadcast
-	initialJob, _ := s.db.GetJob(jobID)
-	if initialJob != nil {
-		s.broadcastJobUpdate(initialJob)
-	}
-
-	// Create job directory structure
-	jobDir := filepath.Join(s.converter.tempDir, jobID)
-	originalDir := filepath.Join(jobDir, "original")
-	convertedDir := filepath.Join(jobDir, "converted")
+	ctx, done := s.trackJob(jobID)
+	defer done()
 
-	// Create directories
-	for _, dir := range []string{originalDir, convertedDir} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			s.logger.Error("failed to create directory",
-				"path", dir,
-				"error", err,
-				"job_id", jobID,
-			)
-			s.updateJobStatus(jobID, StatusFailed, err.Error())
-			return
-		}
+	// The job may have been cancelled between claiming and tracking it
+	if current, err := s.db.GetJob(jobID); err == nil && current.Status != StatusProcessing {
+		s.logger.Info("job cancelled before conversion started", "job_id", jobID)
+		s.removeJobDir(jobID)
+		return
 	}
 
-	// Save original file
-	originalPath := filepath.Join(originalDir, filename)
-	if err := saveFile(file, originalPath); err != nil {
-		s.logger.Error("failed to save original file",
-			"path", originalPath,
-			"error", err,
+	// Broadcast the transition to processing
+	s.broadcastJobUpdate(claimed)
+
+	format, ok := lookupOutputFormat(claimed.TargetFormat)
+	if !ok {
+		s.logger.Error("job has unknown target format",
 			"job_id", jobID,
+			"target_format", claimed.TargetFormat,
 		)
-		s.updateJobStatus(jobID, StatusFailed, err.Error())
+		s.updateJobStatus(jobID, StatusFailed, ErrorCodeInternal, "Unknown target format")
 		return
 	}
 
-	// Run conversion
-	cmd := exec.Command(
-		"libreoffice",
-		"--convert-to", "html:HTML:EmbedImages",
-		"--headless",
-		"--outdir", convertedDir,
-		originalPath,
-	)
+	jobDir := filepath.Join(s.converter.tempDir, jobID)
+	originalPath := s.originalPath(claimed)
+	convertedDir := filepath.Join(jobDir, "converted")
 
-	output, err := cmd.CombinedOutput()
-	outputStr := string(output)
-
-	// Check for specific error patterns in the output
-	if err != nil || strings.Contains(outputStr, "Error:") || strings.Contains(outputStr, "failed:") {
-		errorMsg := "Conversion failed"
-		if strings.Contains(outputStr, "Error:") {
-			// Extract error message between "Error:" and the next newline
-			if idx := strings.Index(outputStr, "Error:"); idx != -1 {
-				errorPart := outputStr[idx:]
-				if newLineIdx := strings.Index(errorPart, "\n"); newLineIdx != -1 {
-					errorMsg = errorPart[:newLineIdx]
-				} else {
-					errorMsg = errorPart
-				}
-			}
+	if s.scanner != nil && !s.scanUpload(ctx, jobID, originalPath) {
+		return
+	}
+
+	// Run conversion
+	artifacts, err := s.converter.Convert(ctx, originalPath, convertedDir, ConvertOptions{
+		JobID:  jobID,
+		Format: format,
+	})
+	if s.stopIfInterrupted(ctx, jobID) {
+		return
+	}
+	if err != nil {
+		errorCode, errorMsg := ErrorCodeConversionFailed, "Conversion failed"
+		var convErr *ConversionError
+		if errors.As(err, &convErr) {
+			errorCode, errorMsg = convErr.Code, convErr.Message
 		}
 
-		s.logger.Error("libreoffice conversion failed",
+		s.logger.Error("conversion failed",
 			"error", err,
-			"output", outputStr,
-			"command", cmd.String(),
+			"error_code", errorCode,
 			"job_id", jobID,
 		)
-		s.updateJobStatus(jobID, StatusFailed, errorMsg)
+		s.updateJobStatus(jobID, StatusFailed, errorCode, errorMsg)
 		return
 	}
 
-	// Log successful conversion
-	s.logger.Info("libreoffice conversion completed",
-		"output", outputStr,
-		"job_id", jobID,
-	)
-
 	// Add permissions check and fix
 	if err := os.Chmod(convertedDir, 0755); err != nil {
 		s.logger.Error("failed to set converted directory permissions",
@@ -418,23 +743,28 @@ func (s *Server) processConversion(jobID string, file io.Reader, filename string
 			"path", convertedDir,
 			"job_id", jobID,
 		)
-		s.updateJobStatus(jobID, StatusFailed, "Failed to set directory permissions")
+		s.updateJobStatus(jobID, StatusFailed, ErrorCodeInternal, "Failed to set directory permissions")
 		return
 	}
 
-	// Get the original filename without extension
-	baseName := strings.TrimSuffix(filepath.Base(originalPath), filepath.Ext(originalPath))
-	convertedFile := filepath.Join(convertedDir, baseName+".html")
+	// The first artifact is the converted document
+	convertedFile := artifacts[0].Path
 
-	// Verify converted file exists and set permissions
-	if _, err := os.Stat(convertedFile); os.IsNotExist(err) {
-		errMsg := "Converted file not found after conversion"
-		s.logger.Error(errMsg,
-			"expected_file", convertedFile,
+	if policy, ok := lookupSanitizePolicy(claimed.SanitizePolicy); ok && policy != nil {
+		if err := sanitizeHTMLFile(convertedFile, policy); err != nil {
+			s.logger.Error("failed to sanitize converted html",
+				"error", err,
+				"path", convertedFile,
+				"policy", policy.Name,
+				"job_id", jobID,
+			)
+			s.updateJobStatus(jobID, StatusFailed, ErrorCodeInternal, "Failed to sanitize HTML output")
+			return
+		}
+		s.logger.Info("sanitized converted html",
 			"job_id", jobID,
+			"policy", policy.Name,
 		)
-		s.updateJobStatus(jobID, StatusFailed, errMsg)
-		return
 	}
 
 	// Set permissions on the converted file
@@ -444,25 +774,42 @@ func (s *Server) processConversion(jobID string, file io.Reader, filename string
 			"path", convertedFile,
 			"job_id", jobID,
 		)
-		s.updateJobStatus(jobID, StatusFailed, "Failed to set file permissions")
+		s.updateJobStatus(jobID, StatusFailed, ErrorCodeInternal, "Failed to set file permissions")
 		return
 	}
 
+	// Record the output size, counted against the owner's storage quota
+	outputBytes, err := dirSize(convertedDir)
+	if err != nil {
+		s.logger.Warn("failed to measure converted files",
+			"error", err,
+			"job_id", jobID,
+		)
+	}
+
 	// Update job with converted file path
 	job := &services.ConvertJob{
 		ID:            jobID,
 		Status:        StatusComplete,
 		ConvertedFile: convertedFile,
+		OutputBytes:   outputBytes,
 		UpdatedAt:     time.Now(),
 	}
 
-	if err := s.db.UpdateJob(job); err != nil {
+	updated, err := s.db.UpdateJobFrom(job, StatusProcessing)
+	if err != nil {
 		s.logger.Error("failed to update job with converted file",
 			"error", err,
 			"job_id", jobID,
 		)
 		return
 	}
+	if !updated {
+		// Cancelled while the conversion was finishing
+		s.logger.Info("discarding result of cancelled job", "job_id", jobID)
+		s.removeJobDir(jobID)
+		return
+	}
 
 	// Get the updated job to broadcast
 	updatedJob, err := s.db.GetJob(jobID)
@@ -476,53 +823,49 @@ func (s *Server) processConversion(jobID string, file io.Reader, filename string
 
 	// Broadcast the final update
 	s.broadcastJobUpdate(updatedJob)
+	s.enqueueWebhook(updatedJob)
 }
 
-func saveFile(src io.Reader, dst string) error {
-	out, err := os.Create(dst)
+// stageUpload streams src to dst, returning its size and hex SHA-256.
+// The data is written to a temporary file in the same directory, synced and
+// renamed into place, so dst either holds the complete upload or does not
+// exist.
+func stageUpload(src io.Reader, dst string) (int64, string, error) {
+	dir := filepath.Dir(dst)
+	tmp, err := os.CreateTemp(dir, ".upload-*")
 	if err != nil {
-		return err
+		return 0, "", err
 	}
-	defer out.Close()
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
 
-	_, err = io.Copy(out, src)
-	return err
-}
-
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
 	if err != nil {
-		s.logger.Error("websocket upgrade failed", "error", err)
-		return
+		tmp.Close()
+		return 0, "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, "", err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return 0, "", err
 	}
 
-	client := &ClientConnection{conn: conn}
-
-	s.clientsMu.Lock()
-	s.clients[client] = true
-	s.clientsMu.Unlock()
-
-	defer func() {
-		s.clientsMu.Lock()
-		delete(s.clients, client)
-		s.clientsMu.Unlock()
-		conn.Close()
-	}()
-
-	for {
-		messageType, _, err := conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				s.logger.Error("websocket error", "error", err)
-			}
-			break
-		}
-		if messageType == websocket.PingMessage {
-			client.mu.Lock()
-			client.conn.WriteMessage(websocket.PongMessage, []byte{})
-			client.mu.Unlock()
-		}
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
 	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func (s *Server) handleDeleteConvert(w http.ResponseWriter, r *http.Request) {
@@ -538,9 +881,13 @@ func (s *Server) handleDeleteConvert(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
+	if !canAccess(caller(r), job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
 
-	// Only allow deletion of completed or failed jobs
-	if job.Status != StatusComplete && job.Status != StatusFailed {
+	// Only allow deletion of finished jobs
+	if job.Status != StatusComplete && job.Status != StatusFailed && job.Status != StatusCancelled && job.Status != StatusRejected {
 		s.logger.Warn("attempted to delete job with invalid status",
 			"job_id", id,
 			"status", job.Status,
@@ -549,15 +896,8 @@ func (s *Server) handleDeleteConvert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete job files
-	jobDir := filepath.Join(s.converter.tempDir, job.ID)
-	if err := os.RemoveAll(jobDir); err != nil {
-		s.logger.Error("failed to remove job directory",
-			"error", err,
-			"path", jobDir,
-		)
-		// Continue with DB deletion even if files deletion fails
-	}
+	// Delete job files, continuing with DB deletion even if this fails
+	s.removeJobDir(job.ID)
 
 	// Delete from database
 	if err := s.db.DeleteJob(id); err != nil {
@@ -570,84 +910,253 @@ func (s *Server) handleDeleteConvert(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Broadcast deletion via websocket
-	s.broadcastJobDelete(id)
+	s.broadcastJobDelete(job)
 
 	// Return 204 No Content
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) broadcastJobDelete(jobID string) {
-	message := WebSocketDeleteMessage{
-		Type:  "job_delete",
-		JobID: jobID,
+// JobActionError reports why an action on a job was refused. Status is the
+// HTTP status of the refusal.
+type JobActionError struct {
+	Status  int
+	Message string
+}
+
+func (e *JobActionError) Error() string {
+	return e.Message
+}
+
+// writeJobActionError responds with the refusal of a job action.
+func (s *Server) writeJobActionError(w http.ResponseWriter, err error) {
+	var quotaErr *QuotaError
+	var actionErr *JobActionError
+	switch {
+	case errors.As(err, &quotaErr):
+		quotaErr.write(w)
+	case errors.As(err, &actionErr):
+		http.Error(w, actionErr.Message, actionErr.Status)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// accessibleJob returns the job id if key may access it.
+func (s *Server) accessibleJob(key *services.APIKey, id string) (*services.ConvertJob, error) {
+	job, err := s.db.GetJob(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !canAccess(key, job)) {
+		return nil, &JobActionError{Status: http.StatusNotFound, Message: "Job not found"}
 	}
+	return job, err
+}
 
-	messageBytes, err := json.Marshal(message)
+func (s *Server) handleCancelConvert(w http.ResponseWriter, r *http.Request) {
+	job, err := s.cancelJob(caller(r), r.PathValue("id"))
 	if err != nil {
-		s.logger.Error("failed to marshal websocket delete message", "error", err)
+		s.writeJobActionError(w, err)
 		return
 	}
 
-	s.clientsMu.RLock()
-	defer s.clientsMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
 
-	for client := range s.clients {
-		client.mu.Lock()
-		err := client.conn.WriteMessage(websocket.TextMessage, messageBytes)
-		client.mu.Unlock()
+// cancelJob cancels a queued or processing job of key.
+func (s *Server) cancelJob(key *services.APIKey, id string) (*services.ConvertJob, error) {
+	job, err := s.accessibleJob(key, id)
+	if err != nil {
+		s.logger.Error("failed to get job for cancellation",
+			"error", err,
+			"id", id,
+		)
+		return nil, err
+	}
 
-		if err != nil {
-			s.logger.Error("failed to send websocket delete message", "error", err)
-			continue
+	if job.Status != StatusQueued && job.Status != StatusProcessing {
+		return nil, &JobActionError{
+			Status:  http.StatusConflict,
+			Message: fmt.Sprintf("Cannot cancel %s job", job.Status),
 		}
 	}
-}
 
-func (s *Server) broadcastJobUpdate(job *services.ConvertJob) {
-	message := WebSocketMessage{
-		Type:    "job_update",
-		Payload: job,
+	// The transition fails if a worker claimed or finished the job meanwhile
+	cancelled, err := s.db.TransitionJob(id, job.Status, StatusCancelled)
+	if err != nil {
+		s.logger.Error("failed to cancel job",
+			"error", err,
+			"id", id,
+		)
+		return nil, err
+	}
+	if !cancelled {
+		return nil, &JobActionError{Status: http.StatusConflict, Message: "Job status changed, please retry"}
+	}
+
+	if job.Status == StatusProcessing {
+		// The worker removes the job files once LibreOffice has been killed
+		s.cancelRunningJob(id)
+	} else {
+		s.removeJobDir(id)
 	}
 
-	messageBytes, err := json.Marshal(message)
+	s.logger.Info("job cancelled",
+		"job_id", id,
+		"previous_status", job.Status,
+	)
+
+	job, err = s.db.GetJob(id)
+	if err != nil {
+		s.logger.Error("failed to get cancelled job", "error", err, "id", id)
+		return nil, err
+	}
+
+	s.broadcastJobUpdate(job)
+	return job, nil
+}
+
+func (s *Server) handleRetryConvert(w http.ResponseWriter, r *http.Request) {
+	job, err := s.retryJob(caller(r), r.PathValue("id"))
 	if err != nil {
-		s.logger.Error("failed to marshal websocket message", "error", err)
+		s.writeJobActionError(w, err)
 		return
 	}
 
-	s.clientsMu.RLock()
-	defer s.clientsMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(JobResponse{
+		ConvertJob: job,
+		Links:      jobLinks(job),
+	})
+}
 
-	for client := range s.clients {
-		client.mu.Lock()
-		err := client.conn.WriteMessage(websocket.TextMessage, messageBytes)
-		client.mu.Unlock()
+// retryJob queues a failed job of key again. The retried job counts against
+// max_concurrent_jobs but not against the daily job quota.
+func (s *Server) retryJob(key *services.APIKey, id string) (*services.ConvertJob, error) {
+	if s.shuttingDown.Load() {
+		return nil, &JobActionError{Status: http.StatusServiceUnavailable, Message: "Server is shutting down"}
+	}
 
-		if err != nil {
-			s.logger.Error("failed to send websocket message", "error", err)
-			continue
+	job, err := s.accessibleJob(key, id)
+	if err != nil {
+		s.logger.Error("failed to get job for retry",
+			"error", err,
+			"id", id,
+		)
+		return nil, err
+	}
+
+	if job.Status != StatusFailed {
+		return nil, &JobActionError{
+			Status:  http.StatusConflict,
+			Message: fmt.Sprintf("Cannot retry %s job", job.Status),
+		}
+	}
+	if _, err := os.Stat(s.originalPath(job)); err != nil {
+		return nil, &JobActionError{Status: http.StatusConflict, Message: "Original file is no longer available"}
+	}
+
+	s.quotaMu.Lock()
+	err = s.checkConcurrentJobs(key)
+	if err == nil && !s.requeueJob(id, StatusFailed) {
+		err = &JobActionError{Status: http.StatusConflict, Message: "Job status changed, please retry"}
+	}
+	s.quotaMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.notifyWorkers()
+
+	job, err = s.db.GetJob(id)
+	if err != nil {
+		s.logger.Error("failed to get retried job", "error", err, "id", id)
+		return nil, err
+	}
+	return job, nil
+}
+
+// removeJobDir deletes the files of a job.
+func (s *Server) removeJobDir(jobID string) {
+	jobDir := filepath.Join(s.converter.tempDir, jobID)
+	if err := os.RemoveAll(jobDir); err != nil {
+		s.logger.Error("failed to remove job directory",
+			"error", err,
+			"path", jobDir,
+		)
+	}
+}
+
+func (s *Server) broadcastJobDelete(job *services.ConvertJob) {
+	s.events.Publish(EventJobDelete, job, func(seq uint64) any {
+		return WebSocketDeleteMessage{
+			Type:  EventJobDelete,
+			Seq:   seq,
+			JobID: job.ID,
 		}
+	})
+}
+
+func (s *Server) broadcastJobUpdate(job *services.ConvertJob) {
+	s.events.Publish(EventJobUpdate, job, func(seq uint64) any {
+		return WebSocketMessage{
+			Type: EventJobUpdate,
+			Seq:  seq,
+			Payload: &JobResponse{
+				ConvertJob: job,
+				Links:      jobLinks(job),
+			},
+		}
+	})
+}
+
+// originalPath returns where the uploaded file of job is stored.
+func (s *Server) originalPath(job *services.ConvertJob) string {
+	if job.OriginalPath != "" {
+		return job.OriginalPath
 	}
+	// Jobs created before the stored path was recorded
+	return filepath.Join(s.converter.tempDir, job.ID, "original", job.OriginalFile)
 }
 
-func (s *Server) updateJobStatus(jobID, status, errorMsg string) {
-	job := &services.ConvertJob{
+// updateJobStatus records the outcome of a job that is being processed. Jobs
+// cancelled in the meantime keep their cancelled status.
+func (s *Server) updateJobStatus(jobID, status, errorCode, errorMsg string) {
+	s.finishJob(&services.ConvertJob{
 		ID:        jobID,
 		Status:    status,
 		Error:     errorMsg,
+		ErrorCode: errorCode,
 		UpdatedAt: time.Now(),
-	}
+	})
+}
 
-	if err := s.db.UpdateJob(job); err != nil {
+// finishJob stores the final state of a job that is still processing and
+// broadcasts it.
+func (s *Server) finishJob(job *services.ConvertJob) {
+	jobID := job.ID
+	updated, err := s.db.UpdateJobFrom(job, StatusProcessing)
+	if err != nil {
 		s.logger.Error("failed to update job status",
 			"error", err,
 			"job_id", jobID,
-			"status", status,
+			"status", job.Status,
+		)
+	} else if !updated {
+		s.logger.Info("job no longer processing, status not updated",
+			"job_id", jobID,
+			"status", job.Status,
 		)
+		s.removeJobDir(jobID)
+		return
+	}
+
+	// Broadcast the stored job so clients receive every field, not just the status
+	if updated, err := s.db.GetJob(jobID); err == nil {
+		job = updated
 	}
 
 	// Broadcast the update to all connected clients
 	s.broadcastJobUpdate(job)
+	s.enqueueWebhook(job)
 }
 
 func setupTempDir(logger *slog.Logger) (string, error) {
@@ -669,6 +1178,45 @@ func setupTempDir(logger *slog.Logger) (string, error) {
 	return tempDir, nil
 }
 
+// envString returns the value of the environment variable key, or def when
+// it is unset.
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// envDuration returns the positive duration value of the environment
+// variable key, or def when it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		logger.Warn("ignoring invalid environment variable", "variable", key, "value", value)
+		return def
+	}
+	return d
+}
+
+// envInt returns the non-negative integer value of the environment variable
+// key, or def when it is unset or invalid.
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		logger.Warn("ignoring invalid environment variable", "variable", key, "value", value)
+		return def
+	}
+	return n
+}
+
 func setupLogger() *slog.Logger {
 	// Get log level from environment
 	logLevel := slog.LevelInfo
@@ -710,19 +1258,12 @@ func (s *Server) startCleanupJob(ctx context.Context) {
 		}
 	}
 
-	retentionPeriod := 24 * time.Hour // Keep files for 24 hours
-	if period := os.Getenv("RETENTION_PERIOD"); period != "" {
-		if d, err := time.ParseDuration(period); err == nil {
-			retentionPeriod = d
-		}
-	}
-
 	ticker := time.NewTicker(cleanupInterval)
 	defer ticker.Stop()
 
 	s.logger.Info("starting cleanup job",
 		"interval", cleanupInterval,
-		"retention_period", retentionPeriod,
+		"retention_period", time.Duration(s.defaultQuotas.RetentionSeconds)*time.Second,
 	)
 
 	for {
@@ -731,43 +1272,96 @@ func (s *Server) startCleanupJob(ctx context.Context) {
 			s.logger.Info("stopping cleanup job")
 			return
 		case <-ticker.C:
-			cutoffTime := time.Now().Add(-retentionPeriod)
-			jobs, err := s.db.GetOldJobs(cutoffTime)
-			if err != nil {
-				s.logger.Error("failed to get old jobs", "error", err)
-				continue
-			}
+			s.cleanupOldJobs()
+		}
+	}
+}
 
-			for _, job := range jobs {
-				// Delete files
-				jobDir := filepath.Join(s.converter.tempDir, job.ID)
-				if err := os.RemoveAll(jobDir); err != nil {
-					s.logger.Error("failed to remove job directory",
-						"error", err,
-						"path", jobDir,
-					)
-					continue
-				}
-
-				// Delete from database
-				if err := s.db.DeleteJob(job.ID); err != nil {
-					s.logger.Error("failed to delete job from database",
-						"error", err,
-						"job_id", job.ID,
-					)
-					continue
-				}
-
-				s.logger.Info("cleaned up old job",
-					"job_id", job.ID,
-					"created_at", job.CreatedAt,
-				)
-			}
+// cleanupOldJobs deletes the jobs older than the retention period of their
+// owner.
+func (s *Server) cleanupOldJobs() {
+	keys, err := s.db.GetAPIKeys()
+	if err != nil {
+		s.logger.Error("failed to get api keys", "error", err)
+		return
+	}
+
+	// Owners keep their jobs for their own retention period
+	defaultRetention := time.Duration(s.defaultQuotas.RetentionSeconds) * time.Second
+	retention := make(map[string]time.Duration)
+	shortest := defaultRetention
+	for _, key := range keys {
+		period := time.Duration(s.quotasFor(key).RetentionSeconds) * time.Second
+		retention[key.ID] = period
+		shortest = min(shortest, period)
+	}
+
+	now := time.Now()
+	jobs, err := s.db.GetOldJobs(now.Add(-shortest))
+	if err != nil {
+		s.logger.Error("failed to get old jobs", "error", err)
+		return
+	}
+
+	for _, job := range jobs {
+		period, ok := retention[job.Owner]
+		if !ok {
+			period = defaultRetention
+		}
+		if job.CreatedAt.After(now.Add(-period)) {
+			continue
 		}
+
+		// Delete files
+		jobDir := filepath.Join(s.converter.tempDir, job.ID)
+		if err := os.RemoveAll(jobDir); err != nil {
+			s.logger.Error("failed to remove job directory",
+				"error", err,
+				"path", jobDir,
+			)
+			continue
+		}
+
+		// Delete from database
+		if err := s.db.DeleteJob(job.ID); err != nil {
+			s.logger.Error("failed to delete job from database",
+				"error", err,
+				"job_id", job.ID,
+			)
+			continue
+		}
+
+		s.logger.Info("cleaned up old job",
+			"job_id", job.ID,
+			"owner", job.Owner,
+			"created_at", job.CreatedAt,
+		)
+		s.broadcastJobDelete(job)
+	}
+
+	// Daily job counts are only needed for the current day
+	if err := s.db.DeleteJobCountsBefore(usageDay(now)); err != nil {
+		s.logger.Error("failed to delete old job counts", "error", err)
+	}
+
+	if err := s.db.DeleteJobEventsBefore(now.Add(-s.eventRetention)); err != nil {
+		s.logger.Error("failed to delete old job events", "error", err)
 	}
 }
 
 func main() {
+	// Subcommands of the conversion sandbox
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case sandboxHelperCommand:
+			os.Exit(runSandboxHelper(os.Args[2:]))
+		case sandboxProbeCommand:
+			os.Exit(runSandboxProbe(os.Args[2:]))
+		case sandboxCheckCommand:
+			os.Exit(runSandboxCheck())
+		}
+	}
+
 	// Initialize logger
 	logger = setupLogger()
 
@@ -789,38 +1383,103 @@ func main() {
 		os.Exit(1)
 	}
 
-	db, err := services.InitDB()
+	dbPath := os.Getenv("APP_DB_PATH")
+	if dbPath == "" {
+		dbPath = "./converter.db"
+	}
+
+	db, err := services.InitDB(dbPath)
 	if err != nil {
 		logger.Error("failed to initialize database", "error", err)
 		os.Exit(1)
 	}
 	defer db.Close()
 
-	converter := NewConverter(tempDir, logger)
-	server := &Server{
-		converter: converter,
-		logger:    logger,
-		db:        db,
-		clients:   make(map[*ClientConnection]bool),
+	backend, err := newBackend(os.Getenv("CONVERTER_BACKEND"), tempDir, logger)
+	if err != nil {
+		logger.Error("failed to set up converter backend", "error", err)
+		os.Exit(1)
 	}
 
-	// Set up routes with logging middleware
-	mux := http.NewServeMux()
+	// Keep LibreOffice running between jobs when a pool is configured
+	if poolSize := envInt("SOFFICE_POOL_SIZE", 0); poolSize > 0 {
+		// Pooled instances are reached over the network the sandbox cuts off,
+		// so they would run unsandboxed
+		if lo, ok := backend.(*LibreOfficeBackend); ok && lo.sandbox != nil {
+			logger.Error("SOFFICE_POOL_SIZE cannot be combined with SANDBOX, pooled instances cannot be sandboxed")
+			os.Exit(1)
+		}
+		pool := NewSofficePool(SofficePoolConfig{
+			Binary:         envString("UNOSERVER_BIN", "unoserver"),
+			Size:           poolSize,
+			BasePort:       envInt("SOFFICE_POOL_BASE_PORT", 2002),
+			MaxConversions: envInt("SOFFICE_POOL_MAX_CONVERSIONS", 200),
+			ProfileDir:     filepath.Join(tempDir, profilesDirName),
+		}, logger)
+		pool.Start()
+		defer pool.Close()
+		backend = NewPooledBackend(pool, backend, logger)
+	}
 
-	// Both / and /panel point to the same handler
-	mux.HandleFunc("GET /", server.handlePanel)
-	mux.HandleFunc("GET /panel", server.handlePanel)
+	converter := NewConverter(tempDir, logger, backend)
+	converter.loadTimeouts()
+	server := NewServer(converter, db, logger)
 
-	// Convert endpoints
-	mux.HandleFunc("GET /converts", server.handleListConverts)
-	mux.HandleFunc("POST /converts", server.handleCreateConvert)
-	mux.HandleFunc("GET /converts/{id}", server.handleGetConvert)
-	mux.HandleFunc("GET /convert-outcomes/{id}", server.handleDownloadConvert)
-	mux.HandleFunc("DELETE /converts/{id}", server.handleDeleteConvert)
-	mux.HandleFunc("GET /ws", server.handleWebSocket)
+	events, err := NewEventBus(db, logger)
+	if err != nil {
+		logger.Error("failed to load job events", "error", err)
+		os.Exit(1)
+	}
+	defer events.Close()
+	server.events = events
+
+	if path := os.Getenv("HTML_SANITIZE_POLICIES_FILE"); path != "" {
+		if err := loadSanitizePolicies(path); err != nil {
+			logger.Error("failed to load html sanitize policies", "error", err, "path", path)
+			os.Exit(1)
+		}
+	}
+
+	if policy := envString("HTML_SANITIZE_POLICY", SanitizePolicyNone); policy != SanitizePolicyNone {
+		if _, ok := lookupSanitizePolicy(policy); !ok {
+			logger.Error("unknown html sanitize policy",
+				"policy", policy,
+				"allowed", sanitizePolicyNames(),
+			)
+			os.Exit(1)
+		}
+		server.sanitizePolicy = strings.ToLower(policy)
+	}
+
+	// Scan uploads for malware when a clamd is configured
+	if address := os.Getenv("CLAMD_ADDRESS"); address != "" {
+		scanner, err := NewClamdScanner(address, envDuration("CLAMD_TIMEOUT", DefaultClamdTimeout))
+		if err != nil {
+			logger.Error("failed to set up virus scanner", "error", err)
+			os.Exit(1)
+		}
+		server.scanner = scanner
+		logger.Info("scanning uploads with clamd", "address", address)
+	}
+
+	if secret := os.Getenv("ADMIN_API_KEY"); secret != "" {
+		if err := server.bootstrapAdminKey(secret); err != nil {
+			logger.Error("failed to store admin api key", "error", err)
+			os.Exit(1)
+		}
+	} else if keys, err := db.GetAPIKeys(); err == nil && len(keys) == 0 {
+		logger.Warn("no api keys configured, set ADMIN_API_KEY to create an admin key")
+	}
 
-	// Wrap all handlers with logging middleware
-	handler := loggingMiddleware(logger, mux)
+	// Relay job events to WebSocket clients
+	go server.runWebSocketHub()
+
+	server.webhooks = NewWebhooks(db, logger,
+		envInt("WEBHOOK_MAX_ATTEMPTS", DefaultWebhookMaxAttempts),
+		strings.EqualFold(os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS"), "true"),
+	)
+
+	handler := server.routes()
 
 	// Configure server
 	srv := &http.Server{
@@ -831,6 +1490,11 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	// Shutdown waits for open requests, so end the event streams
+	srv.RegisterOnShutdown(func() {
+		close(server.closeStreams)
+	})
+
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -838,22 +1502,53 @@ func main() {
 	// Start cleanup job
 	go server.startCleanupJob(ctx)
 
+	// Deliver webhooks, including those pending from a previous run
+	go server.webhooks.Run(ctx)
+
+	// Reconcile jobs left behind by a previous run before workers start
+	if err := server.recoverJobs(); err != nil {
+		logger.Error("failed to recover unfinished jobs", "error", err)
+	}
+
+	// Start conversion workers
+	workersDone := make(chan struct{})
+	go func() {
+		server.runWorkers(ctx, max(envInt("WORKER_COUNT", 2), 1))
+		close(workersDone)
+	}()
+
+	drainTimeout := envDuration("DRAIN_TIMEOUT", DefaultDrainTimeout)
+
 	// Handle shutdown signals
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
+
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		sig := <-sigChan
 
 		logger.Info("received shutdown signal", "signal", sig)
-		cancel() // Cancel context for cleanup job
 
-		// Give cleanup routines time to finish
-		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer shutdownCancel()
+		// The drain timeout counts from the signal
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer drainCancel()
 
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			logger.Error("server shutdown failed", "error", err)
-		}
+		// Refuse new conversions while in-flight requests complete
+		server.beginShutdown()
+		cancel() // Cancel context for cleanup job and stop workers claiming jobs
+
+		// Finish open requests while running conversions drain
+		httpDone := make(chan struct{})
+		go func() {
+			defer close(httpDone)
+			if err := srv.Shutdown(drainCtx); err != nil {
+				logger.Error("server shutdown failed", "error", err)
+			}
+		}()
+
+		server.drainJobs(drainCtx, workersDone)
+		<-httpDone
 	}()
 
 	logger.Info("server starting", "address", ":8080")
@@ -863,4 +1558,8 @@ func main() {
 		)
 		os.Exit(1)
 	}
+
+	// Wait for running conversions before closing the pool and database
+	<-shutdownDone
+	logger.Info("shutdown complete")
 }
@@ -0,0 +1,17 @@
+//go:build !unix
+
+// procgroup_other.go
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup falls back to killing the launched process only.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,292 @@
+// quota.go
+package main
+
+import (
+	"database/sql"
+	"document-converter/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Error codes of requests refused by a tenant quota
+const (
+	ErrorCodeQuotaConcurrentJobs = "quota_concurrent_jobs"
+	ErrorCodeQuotaJobsPerDay     = "quota_jobs_per_day"
+	ErrorCodeQuotaStorage        = "quota_storage"
+	ErrorCodeQuotaFileSize       = "quota_file_size"
+)
+
+// DefaultRetentionPeriod is how long jobs are kept unless RETENTION_PERIOD or
+// the quotas of their owner override it.
+const DefaultRetentionPeriod = 24 * time.Hour
+
+// activeStatuses are the statuses counted against max_concurrent_jobs.
+var activeStatuses = []string{StatusQueued, StatusProcessing}
+
+// storedStatuses are the statuses of jobs whose files stay in the temp
+// directory until they are deleted or cleaned up.
+var storedStatuses = []string{StatusQueued, StatusProcessing, StatusComplete, StatusFailed}
+
+// loadDefaultQuotas reads the quotas of API keys without their own from the
+// QUOTA_* variables and RETENTION_PERIOD. Zero limits are unlimited.
+func loadDefaultQuotas() services.Quotas {
+	return services.Quotas{
+		MaxConcurrentJobs: envInt("QUOTA_MAX_CONCURRENT_JOBS", 0),
+		MaxJobsPerDay:     envInt("QUOTA_MAX_JOBS_PER_DAY", 0),
+		MaxStorageBytes:   int64(envInt("QUOTA_MAX_STORAGE_BYTES", 0)),
+		MaxFileSize:       int64(envInt("QUOTA_MAX_FILE_SIZE", 0)),
+		RetentionSeconds:  int64(envDuration("RETENTION_PERIOD", DefaultRetentionPeriod) / time.Second),
+	}
+}
+
+// quotasFor returns the quotas of key, with the server defaults filled in.
+func (s *Server) quotasFor(key *services.APIKey) services.Quotas {
+	quotas := key.Quotas
+	if quotas.MaxConcurrentJobs == 0 {
+		quotas.MaxConcurrentJobs = s.defaultQuotas.MaxConcurrentJobs
+	}
+	if quotas.MaxJobsPerDay == 0 {
+		quotas.MaxJobsPerDay = s.defaultQuotas.MaxJobsPerDay
+	}
+	if quotas.MaxStorageBytes == 0 {
+		quotas.MaxStorageBytes = s.defaultQuotas.MaxStorageBytes
+	}
+	if quotas.MaxFileSize == 0 {
+		quotas.MaxFileSize = s.defaultQuotas.MaxFileSize
+	}
+	if quotas.RetentionSeconds == 0 {
+		quotas.RetentionSeconds = s.defaultQuotas.RetentionSeconds
+	}
+	return quotas
+}
+
+// usageDay returns the UTC day jobs created at t are counted on.
+func usageDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// nextUsageDay returns when the daily job count following t starts.
+func nextUsageDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// QuotaError reports a request refused by a quota.
+type QuotaError struct {
+	Code    string
+	Message string
+	// RetryAfter is when the quota frees up again, if known
+	RetryAfter time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// write responds with 429 and the reason.
+func (e *QuotaError) write(w http.ResponseWriter) {
+	if !e.RetryAfter.IsZero() {
+		seconds := int(time.Until(e.RetryAfter).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	writeJSONError(w, http.StatusTooManyRequests, e.Code, e.Message)
+}
+
+// checkFileSize refuses uploads larger than the max_file_size of key.
+func (s *Server) checkFileSize(key *services.APIKey, size int64) *QuotaError {
+	if key.Role == RoleAdmin {
+		return nil
+	}
+	if limit := s.quotasFor(key).MaxFileSize; limit > 0 && size > limit {
+		return &QuotaError{
+			Code:    ErrorCodeQuotaFileSize,
+			Message: fmt.Sprintf("Files are limited to %d bytes", limit),
+		}
+	}
+	return nil
+}
+
+// checkQuotas refuses a new job of size bytes for key when it would exceed a
+// quota. Admin keys are not limited. The caller must hold quotaMu until the
+// job is created and counted.
+func (s *Server) checkQuotas(key *services.APIKey, size int64) error {
+	if key.Role == RoleAdmin {
+		return nil
+	}
+	if err := s.checkFileSize(key, size); err != nil {
+		return err
+	}
+
+	quotas := s.quotasFor(key)
+	now := time.Now()
+	usage, err := s.db.GetUsage(key.ID, usageDay(now), activeStatuses, storedStatuses)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case quotas.MaxConcurrentJobs > 0 && usage.ActiveJobs >= quotas.MaxConcurrentJobs:
+		return &QuotaError{
+			Code:    ErrorCodeQuotaConcurrentJobs,
+			Message: fmt.Sprintf("At most %d jobs may be queued or processing", quotas.MaxConcurrentJobs),
+		}
+	case quotas.MaxJobsPerDay > 0 && usage.JobsToday >= quotas.MaxJobsPerDay:
+		return &QuotaError{
+			Code:       ErrorCodeQuotaJobsPerDay,
+			Message:    fmt.Sprintf("At most %d jobs may be created per day", quotas.MaxJobsPerDay),
+			RetryAfter: nextUsageDay(now),
+		}
+	case quotas.MaxStorageBytes > 0 && usage.StorageBytes+size > quotas.MaxStorageBytes:
+		return &QuotaError{
+			Code:    ErrorCodeQuotaStorage,
+			Message: fmt.Sprintf("Stored files are limited to %d bytes, delete finished jobs to free space", quotas.MaxStorageBytes),
+		}
+	}
+	return nil
+}
+
+// checkConcurrentJobs refuses to queue another job of key when it has as many
+// jobs queued or processing as max_concurrent_jobs allows. The caller must
+// hold quotaMu until the job is queued.
+func (s *Server) checkConcurrentJobs(key *services.APIKey) error {
+	if key.Role == RoleAdmin {
+		return nil
+	}
+	limit := s.quotasFor(key).MaxConcurrentJobs
+	if limit == 0 {
+		return nil
+	}
+
+	usage, err := s.db.GetUsage(key.ID, usageDay(time.Now()), activeStatuses, storedStatuses)
+	if err != nil {
+		return err
+	}
+	if usage.ActiveJobs >= limit {
+		return &QuotaError{
+			Code:    ErrorCodeQuotaConcurrentJobs,
+			Message: fmt.Sprintf("At most %d jobs may be queued or processing", limit),
+		}
+	}
+	return nil
+}
+
+// dirSize returns the total size of the files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// UsageResponse reports the quotas of an API key and how much of them is used.
+type UsageResponse struct {
+	KeyID  string          `json:"key_id"`
+	Quotas services.Quotas `json:"quotas"`
+	Usage  *services.Usage `json:"usage"`
+	// Limited is false for admin keys, which are only subject to retention
+	Limited bool `json:"limited"`
+	// DayResetsAt is when jobs_today starts again from zero
+	DayResetsAt time.Time `json:"day_resets_at"`
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	key := caller(r)
+
+	// Admins may look at other keys
+	if id := r.URL.Query().Get("key_id"); id != "" && id != key.ID {
+		if key.Role != RoleAdmin {
+			writeJSONError(w, http.StatusForbidden, ErrorCodeForbidden, "Admin API key required")
+			return
+		}
+		other, err := s.db.GetAPIKey(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.logger.Error("failed to get api key", "error", err, "key_id", id)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		key = other
+	}
+
+	now := time.Now()
+	usage, err := s.db.GetUsage(key.ID, usageDay(now), activeStatuses, storedStatuses)
+	if err != nil {
+		s.logger.Error("failed to get usage", "error", err, "key_id", key.ID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UsageResponse{
+		KeyID:       key.ID,
+		Quotas:      s.quotasFor(key),
+		Usage:       usage,
+		Limited:     key.Role != RoleAdmin,
+		DayResetsAt: nextUsageDay(now),
+	})
+}
+
+// validQuotas reports whether every quota is zero or positive.
+func validQuotas(quotas services.Quotas) bool {
+	return quotas.MaxConcurrentJobs >= 0 && quotas.MaxJobsPerDay >= 0 &&
+		quotas.MaxStorageBytes >= 0 && quotas.MaxFileSize >= 0 && quotas.RetentionSeconds >= 0
+}
+
+func (s *Server) handleUpdateAPIKeyQuotas(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	var quotas services.Quotas
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&quotas); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !validQuotas(quotas) {
+		http.Error(w, "Quotas must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	updated, err := s.db.UpdateAPIKeyQuotas(id, quotas)
+	if err != nil {
+		s.logger.Error("failed to update api key quotas", "error", err, "key_id", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	s.logger.Info("api key quotas updated",
+		"key_id", id,
+		"quotas", quotas,
+		"updated_by", caller(r).ID,
+	)
+
+	key, err := s.db.GetAPIKey(id)
+	if err != nil {
+		s.logger.Error("failed to get api key", "error", err, "key_id", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"document-converter/services"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// errorCode decodes the error_code of an error response.
+func errorCode(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var body struct {
+		ErrorCode string `json:"error_code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding error response: %v", err)
+	}
+	return body.ErrorCode
+}
+
+func (ts *testServer) getUsage(t *testing.T) UsageResponse {
+	t.Helper()
+	resp := ts.do(t, http.MethodGet, "/usage", nil, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /usage: status %d", resp.StatusCode)
+	}
+	var usage UsageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		t.Fatalf("decoding usage: %v", err)
+	}
+	return usage
+}
+
+func TestQuotaConcurrentJobs(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.as(ts.createKey(t, "user", RoleUser, services.Quotas{MaxConcurrentJobs: 1}).Key)
+	docx := makeDocx(t, "hello")
+
+	user.upload(t, "first.docx", docx, "pdf")
+	resp := user.postConvert(t, "second.docx", docx, "pdf")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("upload over max_concurrent_jobs: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if code := errorCode(t, resp); code != ErrorCodeQuotaConcurrentJobs {
+		t.Errorf("error_code = %q, want %q", code, ErrorCodeQuotaConcurrentJobs)
+	}
+
+	// Admins are not limited
+	ts.upload(t, "admin.docx", docx, "pdf")
+
+	// A finished job frees its slot
+	ts.work(t)
+	user.upload(t, "third.docx", docx, "pdf")
+}
+
+func TestQuotaConcurrentJobsOnRetry(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.as(ts.createKey(t, "user", RoleUser, services.Quotas{MaxConcurrentJobs: 1}).Key)
+	ts.backend.Err = errors.New("fake failure")
+	failed := user.upload(t, "failed.docx", makeDocx(t, "failed"), "pdf")
+	ts.work(t)
+	user.upload(t, "queued.docx", makeDocx(t, "queued"), "pdf")
+
+	resp := user.do(t, http.MethodPost, "/converts/"+failed+"/retry", nil, "")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("retry over max_concurrent_jobs: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if code := errorCode(t, resp); code != ErrorCodeQuotaConcurrentJobs {
+		t.Errorf("error_code = %q, want %q", code, ErrorCodeQuotaConcurrentJobs)
+	}
+	if job := user.getJob(t, failed); job.Status != StatusFailed {
+		t.Errorf("refused retry left status %q, want %q", job.Status, StatusFailed)
+	}
+}
+
+func TestQuotaJobsPerDay(t *testing.T) {
+	ts := newTestServer(t)
+	user := ts.as(ts.createKey(t, "user", RoleUser, services.Quotas{MaxJobsPerDay: 2}).Key)
+	docx := makeDocx(t, "hello")
+
+	first := user.upload(t, "first.docx", docx, "pdf")
+	user.upload(t, "second.docx", docx, "pdf")
+
+	// Cancelled and deleted jobs still count for the day
+	if resp := user.cancel(t, first); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: status %d", resp.StatusCode)
+	}
+	if resp := user.do(t, http.MethodDelete, "/converts/"+first, nil, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /converts/%s: status %d", first, resp.StatusCode)
+	}
+
+	resp := user.postConvert(t, "third.docx", docx, "pdf")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("upload over max_jobs_per_day: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("no Retry-After until the next day")
+	}
+	if code := errorCode(t, resp); code != ErrorCodeQuotaJobsPerDay {
+		t.Errorf("error_code = %q, want %q", code, ErrorCodeQuotaJobsPerDay)
+	}
+}
+
+func TestQuotaStorageAndFileSize(t *testing.T) {
+	ts := newTestServer(t)
+	docx := makeDocx(t, "hello")
+	size := int64(len(docx))
+
+	tests := []struct {
+		name   string
+		quotas services.Quotas
+		code   string
+	}{
+		{"file size", services.Quotas{MaxFileSize: size - 1}, ErrorCodeQuotaFileSize},
+		{"storage", services.Quotas{MaxStorageBytes: size + size/2}, ErrorCodeQuotaStorage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := ts.as(ts.createKey(t, tt.name, RoleUser, tt.quotas).Key)
+			if tt.quotas.MaxStorageBytes > 0 {
+				user.upload(t, "first.docx", docx, "pdf")
+			}
+
+			resp := user.postConvert(t, "report.docx", docx, "pdf")
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("upload: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+			}
+			if code := errorCode(t, resp); code != tt.code {
+				t.Errorf("error_code = %q, want %q", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ts := newTestServer(t)
+	created := ts.createKey(t, "user", RoleUser, services.Quotas{MaxJobsPerDay: 5})
+	user := ts.as(created.Key)
+	docx := makeDocx(t, "hello")
+
+	user.upload(t, "first.docx", docx, "pdf")
+	user.upload(t, "second.docx", docx, "pdf")
+	ts.work(t)
+
+	usage := user.getUsage(t)
+	if usage.KeyID != created.ID || !usage.Limited {
+		t.Errorf("usage of %q (limited %v), want %q (limited)", usage.KeyID, usage.Limited, created.ID)
+	}
+	if usage.Quotas.MaxJobsPerDay != 5 {
+		t.Errorf("max_jobs_per_day = %d, want 5", usage.Quotas.MaxJobsPerDay)
+	}
+	if usage.Usage.ActiveJobs != 1 || usage.Usage.JobsToday != 2 {
+		t.Errorf("active_jobs = %d, jobs_today = %d, want 1 and 2", usage.Usage.ActiveJobs, usage.Usage.JobsToday)
+	}
+	if usage.Usage.StorageBytes < 2*int64(len(docx)) {
+		t.Errorf("storage_bytes = %d, want at least both uploads", usage.Usage.StorageBytes)
+	}
+
+	// Only admins look at other keys
+	if resp := user.do(t, http.MethodGet, "/usage?key_id="+bootstrapKeyID, nil, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("usage of another key by a user: status %d, want 403", resp.StatusCode)
+	}
+	resp := ts.do(t, http.MethodGet, "/usage?key_id="+created.ID, nil, "")
+	var other UsageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&other); err != nil {
+		t.Fatal(err)
+	}
+	if other.KeyID != created.ID || other.Usage.JobsToday != 2 {
+		t.Errorf("admin sees usage of %q with %d jobs today, want %q with 2", other.KeyID, other.Usage.JobsToday, created.ID)
+	}
+}
@@ -0,0 +1,175 @@
+// ratelimit.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrorCodeRateLimited is returned with 429 responses of the rate limiter.
+const ErrorCodeRateLimited = "rate_limited"
+
+// Defaults of the POST /converts rate limiter and admission control
+const (
+	DefaultRateLimitPerMinute = 60
+	DefaultRateLimitBurst     = 10
+	DefaultMaxQueueDepth      = 1000
+)
+
+// queueFullRetryAfter is the Retry-After value, in seconds, sent to clients
+// refused because the queue is full.
+const queueFullRetryAfter = "10"
+
+// bucketSweepInterval is how often buckets that refilled completely are
+// dropped.
+const bucketSweepInterval = time.Minute
+
+// RateLimiter is a token bucket per client. Each bucket holds up to burst
+// tokens and refills at rate tokens per second; a request takes one token.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing perMinute requests per minute and
+// bursts of burst requests per client.
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   max(burst, 1),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// RateLimitState describes the bucket of a client after a request.
+type RateLimitState struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token, when not allowed
+	RetryAfter time.Duration
+}
+
+// Allow takes a token from the bucket of client if one is left.
+func (l *RateLimiter) Allow(client string) RateLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.refill(now, l.rate, l.burst)
+
+	state := RateLimitState{Limit: l.burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		state.Allowed = true
+	} else {
+		state.RetryAfter = l.duration(1 - bucket.tokens)
+	}
+	state.Remaining = int(bucket.tokens)
+	state.Reset = l.duration(float64(l.burst) - bucket.tokens)
+	return state
+}
+
+// duration returns how long refilling tokens takes.
+func (l *RateLimiter) duration(tokens float64) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// sweep drops the buckets that are full again; they are recreated full.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, bucket := range l.buckets {
+		bucket.refill(now, l.rate, l.burst)
+		if bucket.tokens >= float64(l.burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// loadRateLimiter returns the limiter configured by RATE_LIMIT_PER_MINUTE and
+// RATE_LIMIT_BURST, or nil when RATE_LIMIT_PER_MINUTE is 0.
+func loadRateLimiter() *RateLimiter {
+	perMinute := envInt("RATE_LIMIT_PER_MINUTE", DefaultRateLimitPerMinute)
+	if perMinute == 0 {
+		return nil
+	}
+	return NewRateLimiter(perMinute, envInt("RATE_LIMIT_BURST", DefaultRateLimitBurst))
+}
+
+// seconds rounds d up to whole seconds for headers.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// admit applies the rate limiter of the caller's API key and the queue depth
+// limit before next reads the request body. It runs behind authMiddleware, so
+// every request has a caller.
+func (s *Server) admit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter != nil {
+			keyID := caller(r).ID
+			state := s.rateLimiter.Allow(keyID)
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(state.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.Remaining))
+			w.Header().Set("RateLimit-Reset", seconds(state.Reset))
+			if !state.Allowed {
+				s.logger.Warn("rate limit exceeded", "key_id", keyID)
+				w.Header().Set("Retry-After", seconds(state.RetryAfter))
+				writeJSONError(w, http.StatusTooManyRequests, ErrorCodeRateLimited, "Too many requests, slow down")
+				return
+			}
+		}
+
+		if s.maxQueueDepth > 0 {
+			queued, err := s.db.CountJobsInStatus(StatusQueued)
+			if err != nil {
+				s.logger.Error("failed to count queued jobs", "error", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if queued >= s.maxQueueDepth {
+				s.logger.Warn("queue full, refusing conversion",
+					"queued", queued,
+					"max_queue_depth", s.maxQueueDepth,
+				)
+				w.Header().Set("Retry-After", queueFullRetryAfter)
+				http.Error(w, "Conversion queue is full", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
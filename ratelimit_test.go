@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRateLimitPerKey(t *testing.T) {
+	ts := newTestServer(t)
+	ts.rateLimiter = NewRateLimiter(1, 1)
+	content := makeDocx(t, "hello")
+
+	ts.upload(t, "report.docx", content, "pdf")
+
+	resp := ts.postConvert(t, "report.docx", content, "pdf")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second upload: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 response without Retry-After")
+	}
+	// The bucket is the API key's
+	if state := ts.rateLimiter.Allow(bootstrapKeyID); state.Allowed {
+		t.Error("bucket of the API key still has tokens")
+	}
+}
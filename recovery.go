@@ -0,0 +1,92 @@
+// recovery.go
+package main
+
+import (
+	"document-converter/services"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recoverJobs reconciles the database and the temp directory after a restart.
+// Jobs left unfinished by a previous process are queued again when their
+// original file is still present and failed as interrupted otherwise. Job
+// directories without a database row are removed.
+func (s *Server) recoverJobs() error {
+	jobs, err := s.db.GetJobsNotInStatus(StatusComplete, StatusFailed, StatusCancelled, StatusRejected)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		s.recoverJob(job)
+	}
+
+	return s.removeOrphanedJobDirs()
+}
+
+func (s *Server) recoverJob(job *services.ConvertJob) {
+	originalPath := s.originalPath(job)
+	if _, err := os.Stat(originalPath); err != nil {
+		s.logger.Warn("original file of unfinished job missing, marking job failed",
+			"job_id", job.ID,
+			"status", job.Status,
+			"path", originalPath,
+		)
+		failed := &services.ConvertJob{
+			ID:        job.ID,
+			Status:    StatusFailed,
+			Error:     "Conversion interrupted by a server restart",
+			ErrorCode: ErrorCodeInterrupted,
+			UpdatedAt: time.Now(),
+		}
+		updated, err := s.db.UpdateJobFrom(failed, job.Status)
+		if err != nil {
+			s.logger.Error("failed to mark interrupted job failed",
+				"error", err,
+				"job_id", job.ID,
+			)
+		} else if updated {
+			if failedJob, err := s.db.GetJob(job.ID); err == nil {
+				s.broadcastJobUpdate(failedJob)
+				s.enqueueWebhook(failedJob)
+			}
+		}
+		return
+	}
+
+	if job.Status == StatusQueued {
+		return
+	}
+
+	s.requeueJob(job.ID, job.Status)
+}
+
+// removeOrphanedJobDirs deletes job directories that have no database row.
+// Only directories named like job IDs are considered.
+func (s *Server) removeOrphanedJobDirs() error {
+	ids, err := s.db.GetJobIDs()
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(s.converter.tempDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || ids[entry.Name()] {
+			continue
+		}
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+
+		s.logger.Info("removing orphaned job directory", "job_id", entry.Name())
+		s.removeJobDir(entry.Name())
+	}
+
+	return nil
+}
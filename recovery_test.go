@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRecoverJobs(t *testing.T) {
+	ts := newTestServer(t)
+	running := ts.upload(t, "running.docx", makeDocx(t, "running"), "pdf")
+	lost := ts.upload(t, "lost.docx", makeDocx(t, "lost"), "pdf")
+	queued := ts.upload(t, "queued.docx", makeDocx(t, "queued"), "pdf")
+
+	// Leave running and lost processing, as a killed server would
+	for range 2 {
+		if _, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing); err != nil {
+			t.Fatalf("ClaimNextJob: %v", err)
+		}
+	}
+	partial := filepath.Join(ts.converter.tempDir, running, "converted", "partial.pdf")
+	if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lostJob, err := ts.db.GetJob(lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(ts.originalPath(lostJob)); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := filepath.Join(ts.converter.tempDir, uuid.NewString())
+	other := filepath.Join(ts.converter.tempDir, "not-a-job")
+	for _, dir := range []string{orphan, other} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ts.recoverJobs(); err != nil {
+		t.Fatalf("recoverJobs: %v", err)
+	}
+
+	if job := ts.getJob(t, queued); job.Status != StatusQueued {
+		t.Errorf("queued job is %q, want %q", job.Status, StatusQueued)
+	}
+	if job := ts.getJob(t, running); job.Status != StatusQueued {
+		t.Errorf("processing job with its upload is %q, want %q", job.Status, StatusQueued)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial output of requeued job kept: %v", err)
+	}
+	if job := ts.getJob(t, lost); job.Status != StatusFailed || job.ErrorCode != ErrorCodeInterrupted {
+		t.Errorf("processing job without its upload is %q with %q, want %q with %q", job.Status, job.ErrorCode, StatusFailed, ErrorCodeInterrupted)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned job directory kept: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("directory not named like a job removed: %v", err)
+	}
+
+	// The requeued jobs convert as usual
+	ts.work(t)
+	ts.work(t)
+	for _, id := range []string{queued, running} {
+		if job := ts.getJob(t, id); job.Status != StatusComplete {
+			t.Errorf("recovered job %s is %q, want %q", id, job.Status, StatusComplete)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// sandbox.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SandboxConfig configures the execution sandbox of LibreOffice conversions.
+// Zero limits leave the corresponding resource unlimited.
+type SandboxConfig struct {
+	// CPUSeconds is the RLIMIT_CPU of the sandboxed process
+	CPUSeconds int
+	// AddressSpaceBytes is the RLIMIT_AS of the sandboxed process
+	AddressSpaceBytes int64
+	// OpenFiles is the RLIMIT_NOFILE of the sandboxed process
+	OpenFiles int
+	// FileSizeBytes is the RLIMIT_FSIZE, the largest file it may write
+	FileSizeBytes int64
+}
+
+// DefaultSandboxConfig is used unless overridden by the SANDBOX_* variables.
+var DefaultSandboxConfig = SandboxConfig{
+	CPUSeconds:        300,
+	AddressSpaceBytes: 4 << 30,
+	OpenFiles:         1024,
+	FileSizeBytes:     512 << 20,
+}
+
+// sandboxHelperCommand is the hidden subcommand the server re-executes itself
+// with inside the new namespaces; it sets up mounts and limits and then
+// executes the sandboxed program.
+const sandboxHelperCommand = "__sandbox-exec"
+
+// sandboxProbeCommand is the hidden subcommand run inside the sandbox by its
+// self-test.
+const sandboxProbeCommand = "__sandbox-probe"
+
+// sandboxCheckCommand runs the sandbox self-test with the configured limits
+// and exits, for checking a host before enabling SANDBOX.
+const sandboxCheckCommand = "sandbox-check"
+
+// errSandboxUnsupported is returned on platforms without the namespaces the
+// sandbox relies on.
+var errSandboxUnsupported = errors.New("sandbox requires Linux user, mount and network namespaces")
+
+// sandboxEnv returns the environment of a sandboxed process: PATH and the
+// locale variables of environ, with HOME and TMPDIR set to home. Everything
+// else, such as ADMIN_API_KEY, stays outside the sandbox.
+func sandboxEnv(environ []string, home string) []string {
+	env := []string{"HOME=" + home, "TMPDIR=" + home}
+	for _, kv := range environ {
+		key, _, _ := strings.Cut(kv, "=")
+		if key == "PATH" || key == "LANG" || key == "LANGUAGE" || strings.HasPrefix(key, "LC_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// loadSandboxConfig returns the sandbox configuration when SANDBOX is set to
+// "namespaces", and nil when it is unset or "none".
+func loadSandboxConfig() (*SandboxConfig, error) {
+	switch mode := envString("SANDBOX", "none"); mode {
+	case "none":
+		return nil, nil
+	case "namespaces":
+	default:
+		return nil, errors.New("unknown SANDBOX mode " + mode)
+	}
+
+	config := DefaultSandboxConfig
+	config.CPUSeconds = envInt("SANDBOX_CPU_SECONDS", config.CPUSeconds)
+	config.AddressSpaceBytes = int64(envInt("SANDBOX_ADDRESS_SPACE_BYTES", int(config.AddressSpaceBytes)))
+	config.OpenFiles = envInt("SANDBOX_OPEN_FILES", config.OpenFiles)
+	config.FileSizeBytes = int64(envInt("SANDBOX_FILE_SIZE_BYTES", int(config.FileSizeBytes)))
+	return &config, nil
+}
+
+// Sandbox runs commands in new user, mount and network namespaces with
+// resource limits. Only the directories passed to Wrap stay writable.
+type Sandbox struct {
+	config SandboxConfig
+}
+
+// NewSandbox returns a sandbox after checking that the host supports it.
+func NewSandbox(config SandboxConfig) (*Sandbox, error) {
+	sandbox := &Sandbox{config: config}
+	if err := sandbox.probe(); err != nil {
+		return nil, err
+	}
+	return sandbox, nil
+}
+
+// Wrap rewrites cmd to run inside the sandbox with writable as the only
+// writable directories. It must be called before cmd is started and after
+// other SysProcAttr settings were made.
+func (s *Sandbox) Wrap(cmd *exec.Cmd, writable ...string) error {
+	return s.wrap(cmd, writable)
+}
+
+// runSandboxCheck implements the sandbox-check subcommand.
+func runSandboxCheck() int {
+	config, err := loadSandboxConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if config == nil {
+		// Check the defaults when the sandbox is not enabled yet
+		config = &DefaultSandboxConfig
+	}
+
+	if _, err := NewSandbox(*config); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox unavailable: %v\n", err)
+		return 1
+	}
+	fmt.Printf("sandbox ok: namespaces available, writes outside the job directory and network access blocked (%+v)\n", *config)
+	return 0
+}
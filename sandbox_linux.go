@@ -0,0 +1,291 @@
+//go:build linux
+
+// sandbox_linux.go
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func (s *Sandbox) wrap(cmd *exec.Cmd, writable []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate server executable: %w", err)
+	}
+
+	args := []string{self, sandboxHelperCommand,
+		"-cpu", strconv.Itoa(s.config.CPUSeconds),
+		"-as", strconv.FormatInt(s.config.AddressSpaceBytes, 10),
+		"-nofile", strconv.Itoa(s.config.OpenFiles),
+		"-fsize", strconv.FormatInt(s.config.FileSizeBytes, 10),
+	}
+	for _, dir := range writable {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-rw", dir)
+	}
+	args = append(args, "--", cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+
+	cmd.Path = self
+	cmd.Args = args
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// Root inside the user namespace is the server's own user outside
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	return nil
+}
+
+// probe runs the sandbox self-test of runSandboxProbe.
+func (s *Sandbox) probe() error {
+	dir, err := os.MkdirTemp("", "sandbox-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	writable := filepath.Join(dir, "writable")
+	if err := os.Mkdir(writable, 0755); err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate server executable: %w", err)
+	}
+	cmd := exec.Command(self, sandboxProbeCommand, writable, dir)
+	if err := s.wrap(cmd, []string{writable}); err != nil {
+		return err
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sandbox self-test failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runSandboxHelper runs inside the new namespaces. It makes every mount
+// except the writable directories read-only, applies the resource limits and
+// replaces itself with the sandboxed program.
+func runSandboxHelper(args []string) int {
+	var writable stringList
+	flags := flag.NewFlagSet(sandboxHelperCommand, flag.ContinueOnError)
+	flags.Var(&writable, "rw", "writable directory, may be repeated")
+	cpu := flags.Uint64("cpu", 0, "RLIMIT_CPU in seconds")
+	as := flags.Uint64("as", 0, "RLIMIT_AS in bytes")
+	nofile := flags.Uint64("nofile", 0, "RLIMIT_NOFILE")
+	fsize := flags.Uint64("fsize", 0, "RLIMIT_FSIZE in bytes")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	command := flags.Args()
+	if len(command) == 0 {
+		fmt.Fprintln(os.Stderr, "sandbox: no command given")
+		return 2
+	}
+
+	if err := setupSandboxMounts(writable); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return 1
+	}
+
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, *cpu},
+		{syscall.RLIMIT_NOFILE, *nofile},
+		{syscall.RLIMIT_FSIZE, *fsize},
+		// Last, as it may keep this process from allocating
+		{syscall.RLIMIT_AS, *as},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+		rlimit := &syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		if err := syscall.Setrlimit(limit.resource, rlimit); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: set resource limit %d: %v\n", limit.resource, err)
+			return 1
+		}
+	}
+
+	// The environment was reduced by Wrap's caller; filter it again in case
+	// the helper is started some other way
+	err := syscall.Exec(command[0], command, sandboxEnv(os.Environ(), os.Getenv("HOME")))
+	fmt.Fprintf(os.Stderr, "sandbox: exec %s: %v\n", command[0], err)
+	return 1
+}
+
+// mountFlags are the per-mount flags a remount must keep; the kernel
+// refuses to clear them inside a user namespace.
+var mountFlags = map[string]uintptr{
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+type mountPoint struct {
+	path     string
+	flags    uintptr
+	readOnly bool
+}
+
+func setupSandboxMounts(writable []string) error {
+	// Keep our mount changes out of the host's mount namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+
+	// Writable directories become mount points of their own, so that
+	// remounting their parents read-only leaves them alone
+	for _, dir := range writable {
+		if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", dir, err)
+		}
+	}
+
+	mounts, err := readMountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if withinAny(mount.path, writable) {
+			continue
+		}
+		flags := syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY | mount.flags
+		if err := syscall.Mount("", mount.path, "", flags, ""); err != nil && !mount.readOnly {
+			return fmt.Errorf("remount %s read-only: %w", mount.path, err)
+		}
+	}
+	return nil
+}
+
+// readMountPoints returns the visible mount points of this process's mount
+// namespace, parents before children.
+func readMountPoints() ([]mountPoint, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mountPoint
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mount := mountPoint{path: unescapeMountPath(fields[4])}
+		for _, option := range strings.Split(fields[5], ",") {
+			mount.flags |= mountFlags[option]
+			mount.readOnly = mount.readOnly || option == "ro"
+		}
+
+		// A later mount on the same path shadows the earlier one
+		if i, ok := index[mount.path]; ok {
+			mounts[i] = mount
+			continue
+		}
+		index[mount.path] = len(mounts)
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes mountinfo uses for spaces and
+// other special characters.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func withinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// runSandboxProbe runs inside the sandbox and checks that writable can be
+// written, readOnly cannot and the network is unreachable.
+func runSandboxProbe(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: "+sandboxProbeCommand+" writable-dir read-only-dir")
+		return 2
+	}
+	writable, readOnly := args[0], args[1]
+
+	var failures []string
+	if err := os.WriteFile(filepath.Join(writable, "probe"), nil, 0644); err != nil {
+		failures = append(failures, fmt.Sprintf("cannot write to %s: %v", writable, err))
+	}
+	if err := os.WriteFile(filepath.Join(readOnly, "probe"), nil, 0644); err == nil {
+		failures = append(failures, fmt.Sprintf("%s is writable", readOnly))
+	} else if !errors.Is(err, syscall.EROFS) {
+		failures = append(failures, fmt.Sprintf("writing to %s failed unexpectedly: %v", readOnly, err))
+	}
+	if conn, err := net.DialTimeout("tcp", "1.1.1.1:443", time.Second); err == nil {
+		conn.Close()
+		failures = append(failures, "network is reachable")
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintln(os.Stderr, strings.Join(failures, "; "))
+		return 1
+	}
+	return 0
+}
+
+// stringList is a flag.Value collecting repeated flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+// sandbox_other.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func (s *Sandbox) wrap(cmd *exec.Cmd, writable []string) error {
+	return errSandboxUnsupported
+}
+
+func (s *Sandbox) probe() error {
+	return errSandboxUnsupported
+}
+
+func runSandboxHelper(args []string) int {
+	fmt.Fprintln(os.Stderr, errSandboxUnsupported)
+	return 1
+}
+
+func runSandboxProbe(args []string) int {
+	fmt.Fprintln(os.Stderr, errSandboxUnsupported)
+	return 1
+}
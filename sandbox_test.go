@@ -0,0 +1,23 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSandboxEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"LANG=en_US.UTF-8",
+		"LC_ALL=C",
+		"HOME=/root",
+		"TMPDIR=/tmp",
+		"ADMIN_API_KEY=secret",
+		"APP_DB_PATH=/data/db",
+	}
+	got := sandboxEnv(environ, "/profile")
+	want := []string{"HOME=/profile", "TMPDIR=/profile", "PATH=/usr/bin", "LANG=en_US.UTF-8", "LC_ALL=C"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sandboxEnv = %q, want %q", got, want)
+	}
+}
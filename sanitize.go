@@ -0,0 +1,354 @@
+// sanitize.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// SanitizePolicyNone leaves converted HTML untouched.
+const SanitizePolicyNone = "none"
+
+// SanitizePolicy is an allowlist applied to converted HTML. Elements not
+// listed are unwrapped, keeping their content, except for those in
+// dropElements, which are removed together with their content. Event handler
+// attributes are removed even when listed.
+type SanitizePolicy struct {
+	// Name is the value accepted in the sanitize_policy form field
+	Name string `json:"name"`
+	// Elements maps allowed elements to the attributes allowed on them
+	Elements map[string][]string `json:"elements"`
+	// GlobalAttrs are allowed on every allowed element
+	GlobalAttrs []string `json:"global_attrs"`
+	// LinkSchemes are the URL schemes allowed in href attributes; fragment
+	// links are always allowed
+	LinkSchemes []string `json:"link_schemes"`
+	// Styles keeps style elements and attributes after removing external
+	// references and script-like constructs from them
+	Styles bool `json:"styles"`
+}
+
+// dropElements are removed together with their content under every policy.
+var dropElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Noscript: true,
+	atom.Iframe:   true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Applet:   true,
+	atom.Form:     true,
+	atom.Input:    true,
+	atom.Button:   true,
+	atom.Select:   true,
+	atom.Textarea: true,
+	atom.Link:     true,
+	atom.Base:     true,
+	atom.Template: true,
+	atom.Svg:      true,
+	atom.Math:     true,
+	atom.Audio:    true,
+	atom.Video:    true,
+	atom.Source:   true,
+	atom.Track:    true,
+}
+
+// Elements LibreOffice uses for text documents and spreadsheets.
+var documentElements = map[string][]string{
+	"html": {"lang", "dir"}, "head": nil, "title": nil, "body": {"bgcolor", "text", "link", "vlink"},
+	"meta": {"charset", "http-equiv", "content"},
+	"p":    {"align"}, "div": {"align"}, "span": nil, "font": {"color", "face", "size"}, "center": nil,
+	"h1": {"align"}, "h2": {"align"}, "h3": {"align"}, "h4": {"align"}, "h5": {"align"}, "h6": {"align"},
+	"b": nil, "i": nil, "u": nil, "s": nil, "strike": nil, "em": nil, "strong": nil, "sup": nil, "sub": nil,
+	"small": nil, "big": nil, "code": nil, "tt": nil, "pre": nil, "blockquote": nil, "address": nil,
+	"br": {"clear"}, "hr": {"align", "size", "width", "noshade"},
+	"ul": {"type"}, "ol": {"type", "start"}, "li": {"type", "value"}, "dl": nil, "dt": nil, "dd": nil,
+	"table":   {"align", "border", "cellpadding", "cellspacing", "width", "frame", "rules", "bgcolor"},
+	"caption": {"align"}, "colgroup": {"span", "width"}, "col": {"span", "width"},
+	"thead": {"align", "valign"}, "tbody": {"align", "valign"}, "tfoot": {"align", "valign"},
+	"tr":  {"align", "valign", "bgcolor", "height"},
+	"td":  {"align", "valign", "bgcolor", "colspan", "rowspan", "width", "height", "nowrap"},
+	"th":  {"align", "valign", "bgcolor", "colspan", "rowspan", "width", "height", "nowrap"},
+	"a":   {"href", "name"},
+	"img": {"src", "alt", "width", "height", "align", "border", "hspace", "vspace"},
+}
+
+var sanitizePolicies = map[string]SanitizePolicy{
+	// standard keeps the document's look: inline styles, fonts and colours
+	"standard": {
+		Name:        "standard",
+		Elements:    withElements(documentElements, "style"),
+		GlobalAttrs: []string{"id", "class", "title", "lang", "dir", "style"},
+		LinkSchemes: []string{"http", "https", "mailto"},
+		Styles:      true,
+	},
+	// strict keeps structure and text only
+	"strict": {
+		Name:        "strict",
+		Elements:    documentElements,
+		GlobalAttrs: []string{"title", "lang", "dir"},
+		LinkSchemes: []string{"https", "mailto"},
+	},
+}
+
+// withElements returns a copy of elements that also allows names.
+func withElements(elements map[string][]string, names ...string) map[string][]string {
+	result := make(map[string][]string, len(elements)+len(names))
+	for name, attrs := range elements {
+		result[name] = attrs
+	}
+	for _, name := range names {
+		result[name] = nil
+	}
+	return result
+}
+
+// lookupSanitizePolicy returns the registered policy for name. ok is true
+// and the policy nil for SanitizePolicyNone.
+func lookupSanitizePolicy(name string) (policy *SanitizePolicy, ok bool) {
+	name = strings.ToLower(name)
+	if name == SanitizePolicyNone {
+		return nil, true
+	}
+	p, ok := sanitizePolicies[name]
+	if !ok {
+		return nil, false
+	}
+	return &p, true
+}
+
+// loadSanitizePolicies adds the policies defined in the JSON file at path, an
+// array of SanitizePolicy objects. Policies may not replace the built-in ones.
+func loadSanitizePolicies(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var policies []SanitizePolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return fmt.Errorf("invalid sanitize policies in %s: %w", path, err)
+	}
+
+	for _, policy := range policies {
+		policy.Name = strings.ToLower(policy.Name)
+		if _, exists := sanitizePolicies[policy.Name]; exists || policy.Name == SanitizePolicyNone {
+			return fmt.Errorf("sanitize policy %q is already defined", policy.Name)
+		}
+		if policy.Name == "" || len(policy.Elements) == 0 {
+			return fmt.Errorf("sanitize policies need a name and elements")
+		}
+
+		// HTML element, attribute and scheme names are case-insensitive
+		elements := make(map[string][]string, len(policy.Elements))
+		for element, attrs := range policy.Elements {
+			elements[strings.ToLower(element)] = lowerAll(attrs)
+		}
+		policy.Elements = elements
+		policy.GlobalAttrs = lowerAll(policy.GlobalAttrs)
+		policy.LinkSchemes = lowerAll(policy.LinkSchemes)
+
+		sanitizePolicies[policy.Name] = policy
+	}
+	return nil
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(v)
+	}
+	return lowered
+}
+
+// sanitizePolicyNames returns the accepted policy names in a stable order.
+func sanitizePolicyNames() []string {
+	names := []string{SanitizePolicyNone}
+	for name := range sanitizePolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// sanitizeHTMLFile rewrites the HTML document at path according to policy.
+func sanitizeHTMLFile(path string, policy *SanitizePolicy) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("parse html: %w", err)
+	}
+	policy.sanitize(doc)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sanitize-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := html.Render(tmp, doc); err != nil {
+		tmp.Close()
+		return fmt.Errorf("render html: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sanitize cleans the children of n in place.
+func (p *SanitizePolicy) sanitize(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+
+		switch child.Type {
+		case html.CommentNode:
+			// Conditional comments can carry markup for old browsers
+			n.RemoveChild(child)
+		case html.ElementNode:
+			p.sanitizeElement(n, child)
+		}
+
+		child = next
+	}
+}
+
+func (p *SanitizePolicy) sanitizeElement(parent, n *html.Node) {
+	attrs, allowed := p.Elements[n.Data]
+	switch {
+	case dropElements[n.DataAtom] || n.Namespace != "":
+		parent.RemoveChild(n)
+		return
+	case n.DataAtom == atom.Meta && !harmlessMeta(n):
+		parent.RemoveChild(n)
+		return
+	case n.DataAtom == atom.Style:
+		if !allowed || !p.Styles {
+			parent.RemoveChild(n)
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.TextNode {
+				child.Data = sanitizeCSS(child.Data)
+			}
+		}
+		n.Attr = nil
+		return
+	case !allowed:
+		// Keep the text of unknown elements
+		p.sanitize(n)
+		for child := n.FirstChild; child != nil; {
+			next := child.NextSibling
+			n.RemoveChild(child)
+			parent.InsertBefore(child, n)
+			child = next
+		}
+		parent.RemoveChild(n)
+		return
+	}
+
+	kept := n.Attr[:0]
+	for _, attr := range n.Attr {
+		if attr.Namespace != "" || !(contains(attrs, attr.Key) || contains(p.GlobalAttrs, attr.Key)) {
+			continue
+		}
+		if strings.HasPrefix(attr.Key, "on") {
+			continue
+		}
+		switch attr.Key {
+		case "href":
+			if !p.allowedLink(attr.Val) {
+				continue
+			}
+		case "src":
+			// Only embedded images; anything else loads an external resource
+			if !isDataImage(attr.Val) {
+				continue
+			}
+		case "style":
+			if !p.Styles {
+				continue
+			}
+			attr.Val = sanitizeCSS(attr.Val)
+		}
+		kept = append(kept, attr)
+	}
+	n.Attr = kept
+
+	p.sanitize(n)
+}
+
+// harmlessMeta reports whether a meta element only declares the charset or
+// describes the document; refresh and similar directives are not harmless.
+func harmlessMeta(n *html.Node) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == "http-equiv" && !strings.EqualFold(attr.Val, "content-type") {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *SanitizePolicy) allowedLink(value string) bool {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "#") {
+		return true
+	}
+	scheme, _, found := strings.Cut(value, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		// Relative links point at files that are not served
+		return false
+	}
+	return contains(p.LinkSchemes, strings.ToLower(scheme))
+}
+
+func isDataImage(value string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), "data:image/")
+}
+
+var (
+	cssURL       = regexp.MustCompile(`(?i)url\s*\(([^)]*)\)`)
+	cssImport    = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	cssDangerous = regexp.MustCompile(`(?i)expression\s*\(|behavior\s*:|-moz-binding|javascript:`)
+)
+
+// sanitizeCSS removes references to external resources and script-like
+// constructs from a style sheet or style attribute.
+func sanitizeCSS(css string) string {
+	// Escapes can hide any of the constructs below
+	if strings.Contains(css, `\`) || cssDangerous.MatchString(css) {
+		return ""
+	}
+	css = cssImport.ReplaceAllString(css, "")
+	return cssURL.ReplaceAllStringFunc(css, func(match string) string {
+		inner := cssURL.FindStringSubmatch(match)[1]
+		inner = strings.Trim(strings.TrimSpace(inner), `'"`)
+		if isDataImage(inner) {
+			return match
+		}
+		return "none"
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
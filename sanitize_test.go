@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSanitizePolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	err := os.WriteFile(path, []byte(`[{
+		"name": "Portal",
+		"elements": {"P": ["Align", "onclick"], "a": ["href"], "body": null},
+		"link_schemes": ["HTTPS"]
+	}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(sanitizePolicies, "portal") })
+
+	if err := loadSanitizePolicies(path); err != nil {
+		t.Fatalf("loadSanitizePolicies: %v", err)
+	}
+	policy, ok := lookupSanitizePolicy("portal")
+	if !ok || policy == nil {
+		t.Fatal("loaded policy portal not found")
+	}
+
+	page := filepath.Join(t.TempDir(), "page.html")
+	input := `<html><body><p align="center" onclick="steal()" class="x">Hi <b>there</b></p>` +
+		`<a href="https://example.com/">ok</a><a href="http://example.com/">plain</a>` +
+		`<script>alert(1)</script></body></html>`
+	if err := os.WriteFile(page, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sanitizeHTMLFile(page, policy); err != nil {
+		t.Fatalf("sanitizeHTMLFile: %v", err)
+	}
+	data, err := os.ReadFile(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+
+	for _, want := range []string{`<p align="center">Hi there</p>`, `<a href="https://example.com/">ok</a>`, `<a>plain</a>`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sanitized output %q does not contain %q", got, want)
+		}
+	}
+	for _, unwanted := range []string{"onclick", "class", "<b>", "script", "alert"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("sanitized output %q contains %q", got, unwanted)
+		}
+	}
+}
+
+func TestLoadSanitizePoliciesRejectsBuiltInNames(t *testing.T) {
+	for _, name := range []string{"none", "STRICT"} {
+		path := filepath.Join(t.TempDir(), "policies.json")
+		err := os.WriteFile(path, []byte(`[{"name": "`+name+`", "elements": {"p": null}}]`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loadSanitizePolicies(path); err == nil {
+			t.Errorf("policy named %q replaced a built-in policy", name)
+		}
+	}
+}
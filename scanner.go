@@ -0,0 +1,218 @@
+// scanner.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"document-converter/services"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScanResult is the verdict of a malware scan.
+type ScanResult struct {
+	Infected bool
+	// Signature names the malware found in infected files
+	Signature string
+}
+
+// Scanner checks uploaded files for malware before they are converted.
+type Scanner interface {
+	Scan(ctx context.Context, path string) (ScanResult, error)
+}
+
+// DefaultClamdTimeout bounds a scan unless CLAMD_TIMEOUT overrides it.
+const DefaultClamdTimeout = 2 * time.Minute
+
+// clamdChunkSize is the size of the chunks streamed to clamd. It must stay
+// below clamd's StreamMaxLength.
+const clamdChunkSize = 64 << 10
+
+// ClamdScanner scans files by streaming them to clamd with the INSTREAM
+// command, so clamd does not need access to the job directory.
+type ClamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamdScanner returns a scanner for the clamd listening at address,
+// either tcp://host:port, unix:///path/to/clamd.sock, a plain host:port or a
+// plain socket path.
+func NewClamdScanner(address string, timeout time.Duration) (*ClamdScanner, error) {
+	scanner := &ClamdScanner{timeout: timeout}
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		scanner.network, scanner.address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		scanner.network, scanner.address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "/"):
+		scanner.network, scanner.address = "unix", address
+	default:
+		scanner.network, scanner.address = "tcp", address
+	}
+	if scanner.address == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", address)
+	}
+	return scanner, nil
+}
+
+func (c *ClamdScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	// Unblock reads and writes once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	reply, err := clamdInstream(conn, f)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		return ScanResult{}, err
+	}
+	return parseClamdReply(reply)
+}
+
+// clamdInstream sends r as a zINSTREAM request on conn and returns clamd's
+// reply.
+func clamdInstream(conn net.Conn, r io.Reader) (string, error) {
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return clamdSendFailed(conn, err)
+	}
+
+	// Each chunk is prefixed with its length; an empty chunk ends the stream
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := w.Write(size); err != nil {
+				return clamdSendFailed(conn, err)
+			}
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return clamdSendFailed(conn, err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := w.Write(size); err != nil {
+		return clamdSendFailed(conn, err)
+	}
+	if err := w.Flush(); err != nil {
+		return clamdSendFailed(conn, err)
+	}
+
+	return readClamdReply(conn)
+}
+
+// clamdSendFailed returns the reply clamd sent before a write to it failed
+// with err, or err. clamd closes the connection when the stream exceeds its
+// limit; its reply explains why.
+func clamdSendFailed(conn net.Conn, err error) (string, error) {
+	if reply, readErr := readClamdReply(conn); readErr == nil && reply != "" {
+		return reply, nil
+	}
+	return "", fmt.Errorf("send to clamd: %w", err)
+}
+
+// readClamdReply reads a NUL terminated reply.
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadBytes(0)
+	if err != nil && !(errors.Is(err, io.EOF) && len(reply) > 0) {
+		return "", fmt.Errorf("read clamd reply: %w", err)
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+// parseClamdReply interprets replies such as "stream: OK" and
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (ScanResult, error) {
+	_, verdict, found := strings.Cut(reply, ": ")
+	if !found {
+		verdict = reply
+	}
+
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{
+			Infected:  true,
+			Signature: strings.TrimSuffix(verdict, " FOUND"),
+		}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanUpload scans the original file of a job that is being processed. It
+// reports whether the conversion may go ahead; otherwise the job has been
+// rejected, failed or interrupted.
+func (s *Server) scanUpload(ctx context.Context, jobID, path string) bool {
+	result, err := s.scanner.Scan(ctx, path)
+	if s.stopIfInterrupted(ctx, jobID) {
+		return false
+	}
+	if err != nil {
+		s.logger.Error("virus scan failed",
+			"error", err,
+			"job_id", jobID,
+		)
+		s.updateJobStatus(jobID, StatusFailed, ErrorCodeScanFailed, "Virus scan failed")
+		return false
+	}
+
+	if !result.Infected {
+		s.logger.Info("virus scan clean", "job_id", jobID)
+		return true
+	}
+
+	s.logger.Warn("virus scan found malware, rejecting job",
+		"job_id", jobID,
+		"signature", result.Signature,
+	)
+
+	// Keep the infected file no longer than needed
+	s.removeJobDir(jobID)
+	s.finishJob(&services.ConvertJob{
+		ID:        jobID,
+		Status:    StatusRejected,
+		Error:     "Malware detected: " + result.Signature,
+		ErrorCode: ErrorCodeInfected,
+		Signature: result.Signature,
+		UpdatedAt: time.Now(),
+	})
+	return false
+}
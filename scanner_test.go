@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd listens on a local port and passes every connection to handle.
+// It returns the address to give NewClamdScanner.
+func fakeClamd(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+// readInstream reads a zINSTREAM request and returns the streamed data. It
+// stops with an error once more than limit bytes have been streamed.
+func readInstream(r *bufio.Reader, limit int) ([]byte, error) {
+	command, err := r.ReadString(0)
+	if err != nil {
+		return nil, err
+	}
+	if command != "zINSTREAM\x00" {
+		return nil, errors.New("unexpected command " + command)
+	}
+
+	var data bytes.Buffer
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			return data.Bytes(), nil
+		}
+		if data.Len()+int(n) > limit {
+			return nil, errors.New("size limit exceeded")
+		}
+		if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unusedAddress returns a local address nothing listens on.
+func unusedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+// replyClamd answers every complete stream with reply.
+func replyClamd(reply string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		if _, err := readInstream(bufio.NewReader(conn), 1<<30); err != nil {
+			return
+		}
+		io.WriteString(conn, reply+"\x00")
+	}
+}
+
+func writeScanFile(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestScanner(t *testing.T, address string, timeout time.Duration) *ClamdScanner {
+	t.Helper()
+	scanner, err := NewClamdScanner(address, timeout)
+	if err != nil {
+		t.Fatalf("NewClamdScanner(%q): %v", address, err)
+	}
+	return scanner
+}
+
+func TestClamdScannerClean(t *testing.T) {
+	// Larger than one chunk, so the stream is split
+	content := bytes.Repeat([]byte("clean document "), clamdChunkSize/5)
+	received := make(chan []byte, 1)
+	address := fakeClamd(t, func(conn net.Conn) {
+		data, err := readInstream(bufio.NewReader(conn), 1<<30)
+		if err != nil {
+			t.Errorf("fake clamd: %v", err)
+			return
+		}
+		received <- data
+		io.WriteString(conn, "stream: OK\x00")
+	})
+
+	result, err := newTestScanner(t, address, time.Second).Scan(context.Background(), writeScanFile(t, content))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if result.Infected {
+		t.Errorf("Scan = %+v, want clean", result)
+	}
+	if data := <-received; !bytes.Equal(data, content) {
+		t.Errorf("clamd received %d bytes, want the %d bytes of the file", len(data), len(content))
+	}
+}
+
+func TestClamdScannerFound(t *testing.T) {
+	address := fakeClamd(t, replyClamd("stream: Eicar-Test-Signature FOUND"))
+
+	result, err := newTestScanner(t, address, time.Second).Scan(context.Background(), writeScanFile(t, []byte("eicar")))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Scan = %+v, want infected with Eicar-Test-Signature", result)
+	}
+}
+
+func TestClamdScannerErrorReply(t *testing.T) {
+	address := fakeClamd(t, replyClamd("stream: Can't allocate memory ERROR"))
+
+	_, err := newTestScanner(t, address, time.Second).Scan(context.Background(), writeScanFile(t, []byte("document")))
+	if err == nil || !strings.Contains(err.Error(), "Can't allocate memory ERROR") {
+		t.Fatalf("Scan error = %v, want clamd's error reply", err)
+	}
+}
+
+func TestClamdScannerSizeLimit(t *testing.T) {
+	// Like clamd, reply as soon as the stream is too long and hang up
+	address := fakeClamd(t, func(conn net.Conn) {
+		if _, err := readInstream(bufio.NewReader(conn), clamdChunkSize); err == nil {
+			t.Error("fake clamd: stream within the size limit")
+		}
+		io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+	})
+
+	content := bytes.Repeat([]byte("x"), 4*clamdChunkSize)
+	_, err := newTestScanner(t, address, time.Second).Scan(context.Background(), writeScanFile(t, content))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Fatalf("Scan error = %v, want the size limit reply", err)
+	}
+}
+
+func TestClamdScannerConnectionLost(t *testing.T) {
+	// Hang up mid-stream without a reply
+	address := fakeClamd(t, func(conn net.Conn) {
+		readInstream(bufio.NewReader(conn), clamdChunkSize)
+	})
+
+	content := bytes.Repeat([]byte("x"), 256*clamdChunkSize)
+	_, err := newTestScanner(t, address, 5*time.Second).Scan(context.Background(), writeScanFile(t, content))
+	if err == nil || !strings.HasPrefix(err.Error(), "send to clamd: ") {
+		t.Fatalf("Scan error = %v, want a send error", err)
+	}
+}
+
+func TestClamdScannerTimeout(t *testing.T) {
+	// Read the stream but never reply
+	address := fakeClamd(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	start := time.Now()
+	_, err := newTestScanner(t, address, 100*time.Millisecond).Scan(context.Background(), writeScanFile(t, []byte("document")))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Scan error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Scan took %s, want it cut off by the timeout", elapsed)
+	}
+}
+
+func TestClamdScannerUnavailable(t *testing.T) {
+	_, err := newTestScanner(t, unusedAddress(t), time.Second).Scan(context.Background(), writeScanFile(t, []byte("document")))
+	if err == nil || !strings.Contains(err.Error(), "connect to clamd") {
+		t.Fatalf("Scan error = %v, want a connection error", err)
+	}
+}
+
+func TestNewClamdScannerAddress(t *testing.T) {
+	tests := []struct {
+		address, network, want string
+	}{
+		{"tcp://clamd:3310", "tcp", "clamd:3310"},
+		{"clamd:3310", "tcp", "clamd:3310"},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock"},
+		{"/run/clamd.sock", "unix", "/run/clamd.sock"},
+	}
+	for _, tt := range tests {
+		scanner := newTestScanner(t, tt.address, time.Second)
+		if scanner.network != tt.network || scanner.address != tt.want {
+			t.Errorf("NewClamdScanner(%q) = %s %s, want %s %s", tt.address, scanner.network, scanner.address, tt.network, tt.want)
+		}
+	}
+	if _, err := NewClamdScanner("tcp://", time.Second); err == nil {
+		t.Error("NewClamdScanner accepted an empty address")
+	}
+}
+
+func TestConvertScanInfected(t *testing.T) {
+	ts := newTestServer(t)
+	ts.scanner = newTestScanner(t, fakeClamd(t, replyClamd("stream: Eicar-Test-Signature FOUND")), time.Second)
+
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+
+	job := ts.getJob(t, id)
+	if job.Status != StatusRejected || job.ErrorCode != ErrorCodeInfected {
+		t.Fatalf("status = %q, error_code = %q, want %q with %q", job.Status, job.ErrorCode, StatusRejected, ErrorCodeInfected)
+	}
+	if len(ts.backend.Calls()) != 0 {
+		t.Errorf("infected upload was converted")
+	}
+}
+
+func TestConvertScannerUnavailable(t *testing.T) {
+	ts := newTestServer(t)
+	ts.scanner = newTestScanner(t, unusedAddress(t), time.Second)
+
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+
+	// Without a verdict the upload is not converted
+	job := ts.getJob(t, id)
+	if job.Status != StatusFailed || job.ErrorCode != ErrorCodeScanFailed {
+		t.Fatalf("status = %q, error_code = %q, want %q with %q", job.Status, job.ErrorCode, StatusFailed, ErrorCodeScanFailed)
+	}
+	if len(ts.backend.Calls()) != 0 {
+		t.Errorf("unscanned upload was converted")
+	}
+}
+
+func TestConvertScanClean(t *testing.T) {
+	ts := newTestServer(t)
+	ts.scanner = newTestScanner(t, fakeClamd(t, replyClamd("stream: OK")), time.Second)
+
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+
+	if job := ts.getJob(t, id); job.Status != StatusComplete {
+		t.Fatalf("status = %q (%s), want %q", job.Status, job.Error, StatusComplete)
+	}
+	if len(ts.backend.Calls()) != 1 {
+		t.Errorf("backend called %d times, want 1", len(ts.backend.Calls()))
+	}
+}
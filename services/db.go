@@ -2,6 +2,9 @@ package services
 
 import (
     "database/sql"
+    "encoding/json"
+    "fmt"
+    "strings"
     "time"
 
     _ "github.com/mattn/go-sqlite3"
@@ -12,17 +15,70 @@ type DB struct {
 }
 
 type ConvertJob struct {
-    ID            string    `json:"id"`
-    OriginalFile  string    `json:"original_file"`
-    ConvertedFile string    `json:"converted_file,omitempty"`
-    Status        string    `json:"status"`
-    Error         string    `json:"error,omitempty"`
-    CreatedAt     time.Time `json:"created_at"`
-    UpdatedAt     time.Time `json:"updated_at"`
+    ID             string    `json:"id"`
+    Owner          string    `json:"owner,omitempty"`
+    OriginalFile   string    `json:"original_file"`
+    OriginalPath   string    `json:"-"`
+    SizeBytes      int64     `json:"size_bytes"`
+    SHA256         string    `json:"sha256,omitempty"`
+    DetectedType   string    `json:"detected_type,omitempty"`
+    ConvertedFile  string    `json:"converted_file,omitempty"`
+    OutputBytes    int64     `json:"output_bytes,omitempty"`
+    TargetFormat   string    `json:"target_format"`
+    SanitizePolicy string    `json:"sanitize_policy,omitempty"`
+    CallbackURL    string    `json:"callback_url,omitempty"`
+    Status         string    `json:"status"`
+    Error          string    `json:"error,omitempty"`
+    ErrorCode      string    `json:"error_code,omitempty"`
+    Signature      string    `json:"signature,omitempty"`
+    CreatedAt      time.Time `json:"created_at"`
+    UpdatedAt      time.Time `json:"updated_at"`
 }
 
-func InitDB() (*DB, error) {
-    db, err := sql.Open("sqlite3", "./converter.db")
+// jobColumns lists the converts columns in the order scanJob expects them.
+const jobColumns = `id, owner, original_file, original_path, size_bytes, sha256, detected_type, converted_file, output_bytes, target_format, sanitize_policy, callback_url, status, error, error_code, signature, created_at, updated_at`
+
+type rowScanner interface {
+    Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (*ConvertJob, error) {
+    job := &ConvertJob{}
+    err := row.Scan(
+        &job.ID,
+        &job.Owner,
+        &job.OriginalFile,
+        &job.OriginalPath,
+        &job.SizeBytes,
+        &job.SHA256,
+        &job.DetectedType,
+        &job.ConvertedFile,
+        &job.OutputBytes,
+        &job.TargetFormat,
+        &job.SanitizePolicy,
+        &job.CallbackURL,
+        &job.Status,
+        &job.Error,
+        &job.ErrorCode,
+        &job.Signature,
+        &job.CreatedAt,
+        &job.UpdatedAt,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return job, nil
+}
+
+// InitDB opens the SQLite database at path, creating the schema if needed.
+func InitDB(path string) (*DB, error) {
+    // Wait for locks instead of failing while workers write concurrently
+    dsn := path + "?_busy_timeout=5000"
+    if strings.Contains(path, "?") {
+        dsn = path + "&_busy_timeout=5000"
+    }
+
+    db, err := sql.Open("sqlite3", dsn)
     if err != nil {
         return nil, err
     }
@@ -31,10 +87,21 @@ func InitDB() (*DB, error) {
     _, err = db.Exec(`
         CREATE TABLE IF NOT EXISTS converts (
             id TEXT PRIMARY KEY,
+            owner TEXT NOT NULL DEFAULT '',
             original_file TEXT NOT NULL,
+            original_path TEXT NOT NULL DEFAULT '',
+            size_bytes INTEGER NOT NULL DEFAULT 0,
+            sha256 TEXT NOT NULL DEFAULT '',
+            detected_type TEXT NOT NULL DEFAULT '',
             converted_file TEXT,
+            output_bytes INTEGER NOT NULL DEFAULT 0,
+            target_format TEXT NOT NULL DEFAULT 'html',
+            sanitize_policy TEXT NOT NULL DEFAULT '',
+            callback_url TEXT NOT NULL DEFAULT '',
             status TEXT NOT NULL,
             error TEXT,
+            error_code TEXT NOT NULL DEFAULT '',
+            signature TEXT NOT NULL DEFAULT '',
             created_at DATETIME NOT NULL,
             updated_at DATETIME NOT NULL
         )
@@ -43,104 +110,339 @@ func InitDB() (*DB, error) {
         return nil, err
     }
 
+    // Bring databases created by older versions up to date
+    columns := []struct{ name, definition string }{
+        {"target_format", "TEXT NOT NULL DEFAULT 'html'"},
+        {"original_path", "TEXT NOT NULL DEFAULT ''"},
+        {"size_bytes", "INTEGER NOT NULL DEFAULT 0"},
+        {"sha256", "TEXT NOT NULL DEFAULT ''"},
+        {"error_code", "TEXT NOT NULL DEFAULT ''"},
+        {"detected_type", "TEXT NOT NULL DEFAULT ''"},
+        {"sanitize_policy", "TEXT NOT NULL DEFAULT ''"},
+        {"signature", "TEXT NOT NULL DEFAULT ''"},
+        {"owner", "TEXT NOT NULL DEFAULT ''"},
+        {"output_bytes", "INTEGER NOT NULL DEFAULT 0"},
+        {"callback_url", "TEXT NOT NULL DEFAULT ''"},
+    }
+    for _, column := range columns {
+        if err := addColumnIfMissing(db, "converts", column.name, column.definition); err != nil {
+            return nil, err
+        }
+    }
+
+    _, err = db.Exec(`CREATE INDEX IF NOT EXISTS converts_owner ON converts (owner, created_at)`)
+    if err != nil {
+        return nil, err
+    }
+
+    // Create api_keys table; only the SHA-256 of each key is stored
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS api_keys (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            key_hash TEXT NOT NULL UNIQUE,
+            role TEXT NOT NULL,
+            max_concurrent_jobs INTEGER NOT NULL DEFAULT 0,
+            max_jobs_per_day INTEGER NOT NULL DEFAULT 0,
+            max_storage_bytes INTEGER NOT NULL DEFAULT 0,
+            max_file_size INTEGER NOT NULL DEFAULT 0,
+            retention_seconds INTEGER NOT NULL DEFAULT 0,
+            webhook_secret TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL
+        )
+    `)
+    if err != nil {
+        return nil, err
+    }
+
+    quotaColumns := []string{"max_concurrent_jobs", "max_jobs_per_day", "max_storage_bytes", "max_file_size", "retention_seconds"}
+    for _, column := range quotaColumns {
+        if err := addColumnIfMissing(db, "api_keys", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+            return nil, err
+        }
+    }
+    if err := addColumnIfMissing(db, "api_keys", "webhook_secret", "TEXT NOT NULL DEFAULT ''"); err != nil {
+        return nil, err
+    }
+
+    // Create job_counts table counting the jobs each owner created per UTC day
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS job_counts (
+            owner TEXT NOT NULL,
+            day TEXT NOT NULL,
+            jobs INTEGER NOT NULL,
+            PRIMARY KEY (owner, day)
+        )
+    `)
+    if err != nil {
+        return nil, err
+    }
+
+    // Create webhook_deliveries table, the outbox of job callbacks
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id TEXT PRIMARY KEY,
+            job_id TEXT NOT NULL,
+            owner TEXT NOT NULL,
+            url TEXT NOT NULL,
+            event TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            status TEXT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at DATETIME NOT NULL,
+            last_status_code INTEGER NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        )
+    `)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`)
+    if err != nil {
+        return nil, err
+    }
+
+    // Create job_events table, the log of job updates clients resume from.
+    // AUTOINCREMENT keeps sequence numbers of pruned events from being reused.
+    _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS job_events (
+            seq INTEGER PRIMARY KEY AUTOINCREMENT,
+            job_id TEXT NOT NULL,
+            owner TEXT NOT NULL,
+            type TEXT NOT NULL,
+            message TEXT NOT NULL,
+            created_at DATETIME NOT NULL
+        )
+    `)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = db.Exec(`CREATE INDEX IF NOT EXISTS job_events_job ON job_events (job_id, seq)`)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = db.Exec(`CREATE INDEX IF NOT EXISTS job_events_owner ON job_events (owner, seq)`)
+    if err != nil {
+        return nil, err
+    }
+
     return &DB{db}, nil
 }
 
+// addColumnIfMissing adds column to table unless it already exists.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+    rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var (
+            cid        int
+            name       string
+            colType    string
+            notNull    int
+            defaultVal sql.NullString
+            primaryKey int
+        )
+        if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+            return err
+        }
+        if name == column {
+            return nil
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    return err
+}
+
 func (db *DB) CreateJob(job *ConvertJob) error {
     _, err := db.Exec(`
         INSERT INTO converts (
-            id, original_file, converted_file, status, error, created_at, updated_at
-        ) VALUES (?, ?, ?, ?, ?, ?, ?)
+            id, owner, original_file, original_path, size_bytes, sha256, detected_type,
+            converted_file, target_format, sanitize_policy, callback_url, status, error, error_code, created_at, updated_at
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `,
         job.ID,
+        job.Owner,
         job.OriginalFile,
+        job.OriginalPath,
+        job.SizeBytes,
+        job.SHA256,
+        job.DetectedType,
         job.ConvertedFile,
+        job.TargetFormat,
+        job.SanitizePolicy,
+        job.CallbackURL,
         job.Status,
         job.Error,
+        job.ErrorCode,
         job.CreatedAt,
         job.UpdatedAt,
     )
     return err
 }
 
-func (db *DB) UpdateJob(job *ConvertJob) error {
-    _, err := db.Exec(`
+// UpdateJobFrom updates job like UpdateJob, but only while the stored job is
+// still in status from. It reports whether the job was updated.
+func (db *DB) UpdateJobFrom(job *ConvertJob, from string) (bool, error) {
+    result, err := db.Exec(`
         UPDATE converts 
         SET status = ?,
             error = ?,
+            error_code = ?,
+            signature = ?,
             converted_file = ?,
+            output_bytes = ?,
             updated_at = ?
-        WHERE id = ?
+        WHERE id = ? AND status = ?
     `,
         job.Status,
         job.Error,
+        job.ErrorCode,
+        job.Signature,
         job.ConvertedFile,
+        job.OutputBytes,
         job.UpdatedAt,
         job.ID,
+        from,
     )
-    return err
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// TransitionJob moves a job from status from to status to. It reports
+// whether the job was in status from.
+func (db *DB) TransitionJob(id, from, to string) (bool, error) {
+    result, err := db.Exec(`
+        UPDATE converts
+        SET status = ?,
+            updated_at = ?
+        WHERE id = ? AND status = ?
+    `, to, time.Now(), id, from)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
 }
 
 func (db *DB) GetJob(id string) (*ConvertJob, error) {
-    job := &ConvertJob{}
-    err := db.QueryRow(`
-        SELECT id, original_file, converted_file, status, error, created_at, updated_at
+    return scanJob(db.QueryRow(`
+        SELECT `+jobColumns+`
         FROM converts
         WHERE id = ?
-    `, id).Scan(
-        &job.ID,
-        &job.OriginalFile,
-        &job.ConvertedFile,
-        &job.Status,
-        &job.Error,
-        &job.CreatedAt,
-        &job.UpdatedAt,
-    )
-    if err != nil {
-        return nil, err
-    }
-    return job, nil
+    `, id))
+}
+
+// ClaimNextJob atomically moves the oldest job in status from to status to
+// and returns it. It returns sql.ErrNoRows when no job is waiting.
+func (db *DB) ClaimNextJob(from, to string) (*ConvertJob, error) {
+    return scanJob(db.QueryRow(`
+        UPDATE converts
+        SET status = ?,
+            updated_at = ?
+        WHERE id = (
+            SELECT id FROM converts
+            WHERE status = ?
+            ORDER BY created_at, rowid
+            LIMIT 1
+        )
+        RETURNING `+jobColumns,
+        to,
+        time.Now(),
+        from,
+    ))
 }
 
 func (db *DB) GetOldJobs(cutoffTime time.Time) ([]*ConvertJob, error) {
     rows, err := db.Query(`
-        SELECT id, original_file, converted_file, status, error, created_at, updated_at
+        SELECT `+jobColumns+`
         FROM converts
         WHERE created_at < ?
     `, cutoffTime)
     if err != nil {
         return nil, err
     }
+    return scanJobs(rows)
+}
+
+// GetJobsNotInStatus returns every job whose status is not one of statuses,
+// oldest first.
+func (db *DB) GetJobsNotInStatus(statuses ...string) ([]*ConvertJob, error) {
+    args := make([]any, len(statuses))
+    for i, status := range statuses {
+        args[i] = status
+    }
+
+    rows, err := db.Query(`
+        SELECT `+jobColumns+`
+        FROM converts
+        WHERE status NOT IN (`+placeholders(len(statuses))+`)
+        ORDER BY created_at, rowid
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    return scanJobs(rows)
+}
+
+// CountJobsInStatus returns the number of jobs in status.
+func (db *DB) CountJobsInStatus(status string) (int, error) {
+    var n int
+    err := db.QueryRow("SELECT COUNT(*) FROM converts WHERE status = ?", status).Scan(&n)
+    return n, err
+}
+
+// GetJobIDs returns the IDs of all stored jobs.
+func (db *DB) GetJobIDs() (map[string]bool, error) {
+    rows, err := db.Query("SELECT id FROM converts")
+    if err != nil {
+        return nil, err
+    }
     defer rows.Close()
 
-    var jobs []*ConvertJob
+    ids := make(map[string]bool)
     for rows.Next() {
-        job := &ConvertJob{}
-        err := rows.Scan(
-            &job.ID,
-            &job.OriginalFile,
-            &job.ConvertedFile,
-            &job.Status,
-            &job.Error,
-            &job.CreatedAt,
-            &job.UpdatedAt,
-        )
-        if err != nil {
+        var id string
+        if err := rows.Scan(&id); err != nil {
             return nil, err
         }
-        jobs = append(jobs, job)
+        ids[id] = true
     }
-    return jobs, rows.Err()
+    return ids, rows.Err()
 }
 
+// DeleteJob deletes a job and its webhook deliveries.
+// DeleteJob removes a job along with its webhook deliveries and recorded
+// events.
 func (db *DB) DeleteJob(id string) error {
+    if _, err := db.Exec("DELETE FROM webhook_deliveries WHERE job_id = ?", id); err != nil {
+        return err
+    }
+    if _, err := db.Exec("DELETE FROM job_events WHERE job_id = ?", id); err != nil {
+        return err
+    }
     _, err := db.Exec("DELETE FROM converts WHERE id = ?", id)
     return err
 }
 
 func (db *DB) GetAllJobs() ([]*ConvertJob, error) {
     rows, err := db.Query(`
-        SELECT id, original_file, converted_file, status, error, created_at, updated_at
+        SELECT ` + jobColumns + `
         FROM converts
         ORDER BY created_at DESC
         LIMIT 100
@@ -148,20 +450,30 @@ func (db *DB) GetAllJobs() ([]*ConvertJob, error) {
     if err != nil {
         return nil, err
     }
+    return scanJobs(rows)
+}
+
+// GetOwnerJobs returns the 100 most recent jobs of owner.
+func (db *DB) GetOwnerJobs(owner string) ([]*ConvertJob, error) {
+    rows, err := db.Query(`
+        SELECT `+jobColumns+`
+        FROM converts
+        WHERE owner = ?
+        ORDER BY created_at DESC
+        LIMIT 100
+    `, owner)
+    if err != nil {
+        return nil, err
+    }
+    return scanJobs(rows)
+}
+
+func scanJobs(rows *sql.Rows) ([]*ConvertJob, error) {
     defer rows.Close()
 
-    var jobs []*ConvertJob
+    jobs := []*ConvertJob{}
     for rows.Next() {
-        job := &ConvertJob{}
-        err := rows.Scan(
-            &job.ID,
-            &job.OriginalFile,
-            &job.ConvertedFile,
-            &job.Status,
-            &job.Error,
-            &job.CreatedAt,
-            &job.UpdatedAt,
-        )
+        job, err := scanJob(rows)
         if err != nil {
             return nil, err
         }
@@ -169,3 +481,480 @@ func (db *DB) GetAllJobs() ([]*ConvertJob, error) {
     }
     return jobs, rows.Err()
 }
+
+// Quotas limit the jobs of an API key. Zero values fall back to the server's
+// defaults.
+type Quotas struct {
+    MaxConcurrentJobs int   `json:"max_concurrent_jobs,omitempty"`
+    MaxJobsPerDay     int   `json:"max_jobs_per_day,omitempty"`
+    MaxStorageBytes   int64 `json:"max_storage_bytes,omitempty"`
+    MaxFileSize       int64 `json:"max_file_size,omitempty"`
+    RetentionSeconds  int64 `json:"retention_seconds,omitempty"`
+}
+
+type APIKey struct {
+    ID        string    `json:"id"`
+    Name      string    `json:"name"`
+    KeyHash   string    `json:"-"`
+    Role      string    `json:"role"`
+    Quotas    Quotas    `json:"quotas"`
+    CreatedAt time.Time `json:"created_at"`
+    // WebhookSecret signs the callbacks of the key's jobs
+    WebhookSecret string `json:"-"`
+}
+
+// apiKeyColumns lists the api_keys columns in the order scanAPIKey expects them.
+const apiKeyColumns = `id, name, key_hash, role, max_concurrent_jobs, max_jobs_per_day, max_storage_bytes, max_file_size, retention_seconds, created_at, webhook_secret`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+    key := &APIKey{}
+    err := row.Scan(
+        &key.ID,
+        &key.Name,
+        &key.KeyHash,
+        &key.Role,
+        &key.Quotas.MaxConcurrentJobs,
+        &key.Quotas.MaxJobsPerDay,
+        &key.Quotas.MaxStorageBytes,
+        &key.Quotas.MaxFileSize,
+        &key.Quotas.RetentionSeconds,
+        &key.CreatedAt,
+        &key.WebhookSecret,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+func (db *DB) CreateAPIKey(key *APIKey) error {
+    _, err := db.Exec(`
+        INSERT INTO api_keys (`+apiKeyColumns+`)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        key.ID,
+        key.Name,
+        key.KeyHash,
+        key.Role,
+        key.Quotas.MaxConcurrentJobs,
+        key.Quotas.MaxJobsPerDay,
+        key.Quotas.MaxStorageBytes,
+        key.Quotas.MaxFileSize,
+        key.Quotas.RetentionSeconds,
+        key.CreatedAt,
+        key.WebhookSecret,
+    )
+    return err
+}
+
+// PutAPIKey stores key, replacing the hash, name and role of an existing key
+// with the same ID. The quotas of an existing key are kept.
+func (db *DB) PutAPIKey(key *APIKey) error {
+    _, err := db.Exec(`
+        INSERT INTO api_keys (id, name, key_hash, role, created_at)
+        VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT (id) DO UPDATE SET
+            name = excluded.name,
+            key_hash = excluded.key_hash,
+            role = excluded.role
+    `, key.ID, key.Name, key.KeyHash, key.Role, key.CreatedAt)
+    return err
+}
+
+// UpdateAPIKeyQuotas replaces the quotas of a key. It reports whether the key
+// exists.
+func (db *DB) UpdateAPIKeyQuotas(id string, quotas Quotas) (bool, error) {
+    result, err := db.Exec(`
+        UPDATE api_keys
+        SET max_concurrent_jobs = ?,
+            max_jobs_per_day = ?,
+            max_storage_bytes = ?,
+            max_file_size = ?,
+            retention_seconds = ?
+        WHERE id = ?
+    `,
+        quotas.MaxConcurrentJobs,
+        quotas.MaxJobsPerDay,
+        quotas.MaxStorageBytes,
+        quotas.MaxFileSize,
+        quotas.RetentionSeconds,
+        id,
+    )
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// GetAPIKeyByHash returns the key whose SHA-256 is hash, or sql.ErrNoRows.
+func (db *DB) GetAPIKeyByHash(hash string) (*APIKey, error) {
+    return scanAPIKey(db.QueryRow(`
+        SELECT `+apiKeyColumns+`
+        FROM api_keys
+        WHERE key_hash = ?
+    `, hash))
+}
+
+func (db *DB) GetAPIKey(id string) (*APIKey, error) {
+    return scanAPIKey(db.QueryRow(`
+        SELECT `+apiKeyColumns+`
+        FROM api_keys
+        WHERE id = ?
+    `, id))
+}
+
+func (db *DB) GetAPIKeys() ([]*APIKey, error) {
+    rows, err := db.Query(`
+        SELECT ` + apiKeyColumns + `
+        FROM api_keys
+        ORDER BY created_at
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var keys []*APIKey
+    for rows.Next() {
+        key, err := scanAPIKey(rows)
+        if err != nil {
+            return nil, err
+        }
+        keys = append(keys, key)
+    }
+    return keys, rows.Err()
+}
+
+// EnsureWebhookSecret sets the webhook secret of a key that has none and
+// returns the key's secret. It returns sql.ErrNoRows for unknown keys.
+func (db *DB) EnsureWebhookSecret(id, secret string) (string, error) {
+    _, err := db.Exec(`
+        UPDATE api_keys
+        SET webhook_secret = ?
+        WHERE id = ? AND webhook_secret = ''
+    `, secret, id)
+    if err != nil {
+        return "", err
+    }
+    var stored string
+    err = db.QueryRow("SELECT webhook_secret FROM api_keys WHERE id = ?", id).Scan(&stored)
+    return stored, err
+}
+
+// DeleteAPIKey revokes a key. It reports whether the key existed.
+func (db *DB) DeleteAPIKey(id string) (bool, error) {
+    result, err := db.Exec("DELETE FROM api_keys WHERE id = ?", id)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// Usage is the resource use of an owner counted against its quotas.
+type Usage struct {
+    // ActiveJobs counts queued and processing jobs
+    ActiveJobs int `json:"active_jobs"`
+    // JobsToday counts the jobs created on the current UTC day, deleted ones included
+    JobsToday int `json:"jobs_today"`
+    // StorageBytes is the size of the uploads and outputs kept on disk
+    StorageBytes int64 `json:"storage_bytes"`
+}
+
+// GetUsage returns the usage of owner. activeStatuses are the statuses of
+// jobs counted as running and storedStatuses those of jobs whose files are
+// kept.
+func (db *DB) GetUsage(owner, day string, activeStatuses, storedStatuses []string) (*Usage, error) {
+    usage := &Usage{}
+
+    args := []any{owner}
+    for _, status := range activeStatuses {
+        args = append(args, status)
+    }
+    err := db.QueryRow(`
+        SELECT COUNT(*)
+        FROM converts
+        WHERE owner = ? AND status IN (`+placeholders(len(activeStatuses))+`)
+    `, args...).Scan(&usage.ActiveJobs)
+    if err != nil {
+        return nil, err
+    }
+
+    args = []any{owner}
+    for _, status := range storedStatuses {
+        args = append(args, status)
+    }
+    err = db.QueryRow(`
+        SELECT COALESCE(SUM(size_bytes + output_bytes), 0)
+        FROM converts
+        WHERE owner = ? AND status IN (`+placeholders(len(storedStatuses))+`)
+    `, args...).Scan(&usage.StorageBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    err = db.QueryRow(`
+        SELECT COALESCE(SUM(jobs), 0)
+        FROM job_counts
+        WHERE owner = ? AND day = ?
+    `, owner, day).Scan(&usage.JobsToday)
+    if err != nil {
+        return nil, err
+    }
+    return usage, nil
+}
+
+// CountJob adds a job created by owner on day to the daily job counts.
+func (db *DB) CountJob(owner, day string) error {
+    _, err := db.Exec(`
+        INSERT INTO job_counts (owner, day, jobs)
+        VALUES (?, ?, 1)
+        ON CONFLICT (owner, day) DO UPDATE SET jobs = jobs + 1
+    `, owner, day)
+    return err
+}
+
+// DeleteJobCountsBefore removes the daily job counts of days before day.
+func (db *DB) DeleteJobCountsBefore(day string) error {
+    _, err := db.Exec("DELETE FROM job_counts WHERE day < ?", day)
+    return err
+}
+
+func placeholders(n int) string {
+    return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+type WebhookDelivery struct {
+    ID             string          `json:"id"`
+    JobID          string          `json:"job_id"`
+    Owner          string          `json:"-"`
+    URL            string          `json:"url"`
+    Event          string          `json:"event"`
+    Payload        json.RawMessage `json:"payload"`
+    Status         string          `json:"status"`
+    Attempts       int             `json:"attempts"`
+    NextAttemptAt  time.Time       `json:"next_attempt_at"`
+    LastStatusCode int             `json:"last_status_code,omitempty"`
+    LastError      string          `json:"last_error,omitempty"`
+    CreatedAt      time.Time       `json:"created_at"`
+    UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// deliveryColumns lists the webhook_deliveries columns in the order
+// scanDelivery expects them.
+const deliveryColumns = `id, job_id, owner, url, event, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, updated_at`
+
+func scanDelivery(row rowScanner) (*WebhookDelivery, error) {
+    d := &WebhookDelivery{}
+    var payload string
+    err := row.Scan(
+        &d.ID,
+        &d.JobID,
+        &d.Owner,
+        &d.URL,
+        &d.Event,
+        &payload,
+        &d.Status,
+        &d.Attempts,
+        &d.NextAttemptAt,
+        &d.LastStatusCode,
+        &d.LastError,
+        &d.CreatedAt,
+        &d.UpdatedAt,
+    )
+    if err != nil {
+        return nil, err
+    }
+    d.Payload = json.RawMessage(payload)
+    return d, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+    defer rows.Close()
+
+    var deliveries []*WebhookDelivery
+    for rows.Next() {
+        d, err := scanDelivery(rows)
+        if err != nil {
+            return nil, err
+        }
+        deliveries = append(deliveries, d)
+    }
+    return deliveries, rows.Err()
+}
+
+func (db *DB) CreateDelivery(d *WebhookDelivery) error {
+    _, err := db.Exec(`
+        INSERT INTO webhook_deliveries (`+deliveryColumns+`)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+        d.ID,
+        d.JobID,
+        d.Owner,
+        d.URL,
+        d.Event,
+        string(d.Payload),
+        d.Status,
+        d.Attempts,
+        d.NextAttemptAt,
+        d.LastStatusCode,
+        d.LastError,
+        d.CreatedAt,
+        d.UpdatedAt,
+    )
+    return err
+}
+
+// ClaimDueDeliveries returns up to limit deliveries in status that are due
+// at now, postponing their next attempt to leaseUntil so that a delivery
+// interrupted by a restart is attempted again.
+func (db *DB) ClaimDueDeliveries(status string, now, leaseUntil time.Time, limit int) ([]*WebhookDelivery, error) {
+    rows, err := db.Query(`
+        UPDATE webhook_deliveries
+        SET next_attempt_at = ?
+        WHERE id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status = ? AND next_attempt_at <= ?
+            ORDER BY next_attempt_at
+            LIMIT ?
+        )
+        RETURNING `+deliveryColumns,
+        leaseUntil,
+        status,
+        now,
+        limit,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return scanDeliveries(rows)
+}
+
+// UpdateDelivery records the outcome of a delivery attempt.
+func (db *DB) UpdateDelivery(d *WebhookDelivery) error {
+    _, err := db.Exec(`
+        UPDATE webhook_deliveries
+        SET status = ?,
+            attempts = ?,
+            next_attempt_at = ?,
+            last_status_code = ?,
+            last_error = ?,
+            updated_at = ?
+        WHERE id = ?
+    `,
+        d.Status,
+        d.Attempts,
+        d.NextAttemptAt,
+        d.LastStatusCode,
+        d.LastError,
+        d.UpdatedAt,
+        d.ID,
+    )
+    return err
+}
+
+// GetJobDeliveries returns the webhook deliveries of a job, oldest first.
+func (db *DB) GetJobDeliveries(jobID string) ([]*WebhookDelivery, error) {
+    rows, err := db.Query(`
+        SELECT `+deliveryColumns+`
+        FROM webhook_deliveries
+        WHERE job_id = ?
+        ORDER BY created_at, rowid
+    `, jobID)
+    if err != nil {
+        return nil, err
+    }
+    return scanDeliveries(rows)
+}
+
+// JobEvent is a recorded change of a job, as sent to clients.
+type JobEvent struct {
+    Seq       uint64          `json:"seq"`
+    Type      string          `json:"type"`
+    JobID     string          `json:"job_id"`
+    Owner     string          `json:"-"`
+    Message   json.RawMessage `json:"message"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+// EventQuery selects job events after a sequence number. Empty Owner and
+// JobID do not filter.
+type EventQuery struct {
+    After uint64
+    Owner string
+    JobID string
+    Limit int
+}
+
+// CreateJobEvent records an event under the sequence number it was assigned.
+func (db *DB) CreateJobEvent(e *JobEvent) error {
+    _, err := db.Exec(`
+        INSERT INTO job_events (seq, job_id, owner, type, message, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `,
+        e.Seq,
+        e.JobID,
+        e.Owner,
+        e.Type,
+        string(e.Message),
+        e.CreatedAt,
+    )
+    return err
+}
+
+// LastJobEventSeq returns the highest sequence number ever recorded, including
+// pruned events.
+func (db *DB) LastJobEventSeq() (uint64, error) {
+    var seq uint64
+    err := db.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'job_events'`).Scan(&seq)
+    if err == sql.ErrNoRows {
+        return 0, nil
+    }
+    return seq, err
+}
+
+// GetJobEvents returns up to q.Limit events matching q, oldest first.
+func (db *DB) GetJobEvents(q EventQuery) ([]*JobEvent, error) {
+    where := "seq > ?"
+    args := []any{q.After}
+    if q.Owner != "" {
+        where += " AND owner = ?"
+        args = append(args, q.Owner)
+    }
+    if q.JobID != "" {
+        where += " AND job_id = ?"
+        args = append(args, q.JobID)
+    }
+    args = append(args, q.Limit)
+
+    rows, err := db.Query(`
+        SELECT seq, job_id, owner, type, message, created_at
+        FROM job_events
+        WHERE `+where+`
+        ORDER BY seq
+        LIMIT ?
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    events := []*JobEvent{}
+    for rows.Next() {
+        e := &JobEvent{}
+        var message string
+        if err := rows.Scan(&e.Seq, &e.JobID, &e.Owner, &e.Type, &message, &e.CreatedAt); err != nil {
+            return nil, err
+        }
+        e.Message = json.RawMessage(message)
+        events = append(events, e)
+    }
+    return events, rows.Err()
+}
+
+// DeleteJobEventsBefore removes the events recorded before cutoff.
+func (db *DB) DeleteJobEventsBefore(cutoff time.Time) error {
+    _, err := db.Exec(`DELETE FROM job_events WHERE created_at < ?`, cutoff)
+    return err
+}
@@ -0,0 +1,260 @@
+// sniff.go
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	zipMagic  = []byte("PK\x03\x04")
+	ole2Magic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+	// errUnknownDocument is returned when the content is not a supported
+	// document type, whatever its extension claims.
+	errUnknownDocument = errors.New("unrecognized document content")
+
+	// errEncryptedDocument is returned for password protected OOXML
+	// documents, which are stored as OLE2 files.
+	errEncryptedDocument = errors.New("document is encrypted")
+)
+
+// OOXML main part content types mapped to the document MIME type.
+var ooxmlMainParts = map[string]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml":       "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// sniffDocument determines the MIME type of the document at path from its
+// content. ZIP containers are identified by the ODF mimetype entry or the
+// OOXML [Content_Types].xml; OLE2 compound files by their directory entries.
+func sniffDocument(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(ole2Magic))
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, zipMagic):
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		return sniffZip(f, info.Size())
+	case bytes.HasPrefix(header, ole2Magic):
+		return sniffOLE2(f)
+	default:
+		return "", errUnknownDocument
+	}
+}
+
+func sniffZip(r io.ReaderAt, size int64) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid zip archive", errUnknownDocument)
+	}
+
+	for _, file := range archive.File {
+		switch file.Name {
+		case "mimetype":
+			// ODF stores its MIME type uncompressed in this entry
+			data, err := readZipEntry(file, 256)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(data)), nil
+		case "[Content_Types].xml":
+			data, err := readZipEntry(file, 1<<20)
+			if err != nil {
+				return "", err
+			}
+			return ooxmlType(data)
+		}
+	}
+
+	return "", errUnknownDocument
+}
+
+// readZipEntry reads at most limit bytes of file.
+func readZipEntry(file *zip.File, limit int64) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, limit))
+}
+
+// ooxmlType returns the document type declared by an OOXML
+// [Content_Types].xml.
+func ooxmlType(data []byte) (string, error) {
+	var types struct {
+		Overrides []struct {
+			PartName    string `xml:"PartName,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		} `xml:"Override"`
+	}
+	if err := xml.Unmarshal(data, &types); err != nil {
+		return "", fmt.Errorf("%w: invalid [Content_Types].xml", errUnknownDocument)
+	}
+
+	for _, override := range types.Overrides {
+		if mimeType, ok := ooxmlMainParts[override.ContentType]; ok {
+			return mimeType, nil
+		}
+	}
+	return "", errUnknownDocument
+}
+
+// OLE2 stream names mapped to the document MIME type. Legacy documents are
+// not accepted; they are only recognized to report the mismatch.
+var ole2Streams = map[string]string{
+	"WordDocument": "application/msword",
+	"Workbook":     "application/vnd.ms-excel",
+	"Book":         "application/vnd.ms-excel",
+}
+
+// ole2EncryptedPackage is the stream holding an encrypted OOXML document.
+const ole2EncryptedPackage = "EncryptedPackage"
+
+func sniffOLE2(f *os.File) (string, error) {
+	names, err := ole2EntryNames(f)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errUnknownDocument, err)
+	}
+	for _, name := range names {
+		if name == ole2EncryptedPackage {
+			return "", errEncryptedDocument
+		}
+	}
+	for _, name := range names {
+		if mimeType, ok := ole2Streams[name]; ok {
+			return mimeType, nil
+		}
+	}
+	return "", errUnknownDocument
+}
+
+// ole2EntryNames returns the names of the directory entries of an OLE2
+// compound file.
+func ole2EntryNames(f *os.File) ([]string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 512)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	sectorShift := binary.LittleEndian.Uint16(header[0x1E:])
+	if sectorShift != 9 && sectorShift != 12 {
+		return nil, fmt.Errorf("invalid sector size 2^%d", sectorShift)
+	}
+	sectorSize := int64(1) << sectorShift
+	maxSectors := uint32(info.Size()/sectorSize) + 1
+
+	sectorOffset := func(sector uint32) int64 {
+		return (int64(sector) + 1) * sectorSize
+	}
+	readSector := func(sector uint32) ([]byte, error) {
+		if sector >= maxSectors {
+			return nil, fmt.Errorf("sector %d out of range", sector)
+		}
+		buf := make([]byte, sectorSize)
+		if _, err := f.ReadAt(buf, sectorOffset(sector)); err != nil {
+			return nil, fmt.Errorf("read sector %d: %w", sector, err)
+		}
+		return buf, nil
+	}
+
+	// Collect the FAT sector locations from the header and the DIFAT chain
+	const endOfChain = 0xFFFFFFFE
+	var fatSectors []uint32
+	for i := 0; i < 109; i++ {
+		sector := binary.LittleEndian.Uint32(header[0x4C+4*i:])
+		if sector < maxSectors {
+			fatSectors = append(fatSectors, sector)
+		}
+	}
+	difat := binary.LittleEndian.Uint32(header[0x44:])
+	for steps := uint32(0); difat < maxSectors && steps < maxSectors; steps++ {
+		buf, err := readSector(difat)
+		if err != nil {
+			return nil, err
+		}
+		entries := int(sectorSize/4) - 1
+		for i := 0; i < entries; i++ {
+			sector := binary.LittleEndian.Uint32(buf[4*i:])
+			if sector < maxSectors {
+				fatSectors = append(fatSectors, sector)
+			}
+		}
+		difat = binary.LittleEndian.Uint32(buf[4*entries:])
+	}
+
+	nextSector := func(sector uint32) (uint32, error) {
+		perSector := uint32(sectorSize / 4)
+		index := sector / perSector
+		if int(index) >= len(fatSectors) {
+			return 0, fmt.Errorf("sector %d not covered by the FAT", sector)
+		}
+		buf := make([]byte, 4)
+		offset := sectorOffset(fatSectors[index]) + int64(sector%perSector)*4
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(buf), nil
+	}
+
+	// Walk the directory chain; every entry is 128 bytes
+	var names []string
+	sector := binary.LittleEndian.Uint32(header[0x30:])
+	for steps := uint32(0); sector != endOfChain; steps++ {
+		if steps >= maxSectors {
+			return nil, errors.New("directory chain loops")
+		}
+		buf, err := readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		for offset := 0; offset+128 <= len(buf); offset += 128 {
+			entry := buf[offset : offset+128]
+			if entry[0x42] == 0 {
+				// Unused entry
+				continue
+			}
+			nameLen := int(binary.LittleEndian.Uint16(entry[0x40:]))
+			if nameLen < 2 || nameLen > 64 {
+				continue
+			}
+			units := make([]uint16, nameLen/2-1)
+			for i := range units {
+				units[i] = binary.LittleEndian.Uint16(entry[2*i:])
+			}
+			names = append(names, string(utf16.Decode(units)))
+		}
+		if sector, err = nextSector(sector); err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
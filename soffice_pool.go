@@ -0,0 +1,529 @@
+// soffice_pool.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sofficeStartupTimeout bounds how long a new instance may take to
+	// start listening
+	sofficeStartupTimeout = 60 * time.Second
+	// sofficeHealthTimeout bounds the health check done before each use
+	sofficeHealthTimeout = time.Second
+	// sofficeMaxBackoff caps the delay between restarts of a crashing instance
+	sofficeMaxBackoff = 30 * time.Second
+)
+
+// SofficePoolConfig configures a SofficePool.
+type SofficePoolConfig struct {
+	// Binary is the unoserver executable
+	Binary string
+	// Size is the number of instances kept running
+	Size int
+	// BasePort is the first local port used; instance i listens for
+	// XML-RPC on BasePort+2i and for UNO on BasePort+2i+1
+	BasePort int
+	// MaxConversions restarts an instance after it served this many jobs
+	MaxConversions int
+	// ProfileDir holds the user profile of every instance
+	ProfileDir string
+}
+
+// SofficePool keeps long-lived headless LibreOffice instances, each wrapped
+// by unoserver, so conversions do not pay LibreOffice's cold start. Every
+// instance is supervised: it is health-checked before use, restarted after
+// MaxConversions jobs and restarted with backoff when it crashes.
+type SofficePool struct {
+	config SofficePoolConfig
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	idle  []*sofficeInstance
+	ready chan struct{}
+	alive atomic.Int32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// sofficeInstance is one running unoserver process.
+type sofficeInstance struct {
+	slot        int
+	port        int
+	cmd         *exec.Cmd
+	exited      chan struct{}
+	conversions int
+}
+
+func NewSofficePool(config SofficePoolConfig, logger *slog.Logger) *SofficePool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SofficePool{
+		config: config,
+		logger: logger,
+		ready:  make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start launches the supervisors of every instance. Instances become usable
+// in the background as soon as they accept connections.
+func (p *SofficePool) Start() {
+	p.logger.Info("starting soffice pool",
+		"size", p.config.Size,
+		"base_port", p.config.BasePort,
+		"max_conversions", p.config.MaxConversions,
+	)
+	for slot := 0; slot < p.config.Size; slot++ {
+		p.wg.Add(1)
+		go p.supervise(slot)
+	}
+}
+
+// Close stops every instance and waits for the supervisors to return.
+func (p *SofficePool) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// Available reports whether at least one instance is running.
+func (p *SofficePool) Available() bool {
+	return p.alive.Load() > 0
+}
+
+// supervise keeps the instance in slot running until the pool is closed.
+func (p *SofficePool) supervise(slot int) {
+	defer p.wg.Done()
+
+	backoff := time.Second
+	for {
+		inst, err := p.startInstance(slot)
+		if errors.Is(err, exec.ErrNotFound) {
+			p.logger.Error("soffice pool binary not found, pool disabled",
+				"binary", p.config.Binary,
+				"slot", slot,
+			)
+			return
+		}
+		if err == nil {
+			backoff = time.Second
+			p.alive.Add(1)
+			p.putIdle(inst)
+
+			select {
+			case <-inst.exited:
+				p.logger.Warn("soffice instance exited", "slot", slot, "pid", inst.cmd.Process.Pid)
+			case <-p.ctx.Done():
+				killProcessGroup(inst.cmd)
+				<-inst.exited
+			}
+			p.removeIdle(inst)
+			p.alive.Add(-1)
+		} else {
+			p.logger.Error("failed to start soffice instance",
+				"error", err,
+				"slot", slot,
+			)
+		}
+
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, sofficeMaxBackoff)
+	}
+}
+
+// startInstance launches unoserver for slot and waits until it listens.
+func (p *SofficePool) startInstance(slot int) (*sofficeInstance, error) {
+	port := p.config.BasePort + 2*slot
+	profile := filepath.Join(p.config.ProfileDir, fmt.Sprintf("pool-%d", slot))
+	if err := os.RemoveAll(profile); err != nil {
+		return nil, err
+	}
+	profileURL := url.URL{Scheme: "file", Path: filepath.ToSlash(profile)}
+
+	cmd := exec.Command(p.config.Binary,
+		"--interface", "127.0.0.1",
+		"--port", fmt.Sprint(port),
+		"--uno-port", fmt.Sprint(port+1),
+		"--user-installation", profileURL.String(),
+	)
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	inst := &sofficeInstance{
+		slot:   slot,
+		port:   port,
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		close(inst.exited)
+	}()
+
+	deadline := time.Now().Add(sofficeStartupTimeout)
+	for {
+		if inst.healthy() {
+			p.logger.Info("soffice instance ready",
+				"slot", slot,
+				"port", port,
+				"pid", cmd.Process.Pid,
+			)
+			return inst, nil
+		}
+		if time.Now().After(deadline) {
+			killProcessGroup(cmd)
+			<-inst.exited
+			return nil, fmt.Errorf("instance did not listen on port %d within %s", port, sofficeStartupTimeout)
+		}
+		select {
+		case <-inst.exited:
+			return nil, fmt.Errorf("instance exited during startup: %v", cmd.ProcessState)
+		case <-p.ctx.Done():
+			killProcessGroup(cmd)
+			<-inst.exited
+			return nil, p.ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// healthy reports whether the process is running and accepts connections.
+func (i *sofficeInstance) healthy() bool {
+	select {
+	case <-i.exited:
+		return false
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", i.addr(), sofficeHealthTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (i *sofficeInstance) addr() string {
+	return fmt.Sprintf("127.0.0.1:%d", i.port)
+}
+
+// kill stops the instance; its supervisor starts a replacement.
+func (i *sofficeInstance) kill() {
+	killProcessGroup(i.cmd)
+}
+
+// putIdle makes inst available to acquire.
+func (p *SofficePool) putIdle(inst *sofficeInstance) {
+	p.mu.Lock()
+	p.idle = append(p.idle, inst)
+	p.mu.Unlock()
+
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// takeIdle removes and returns an idle instance, or nil if there is none.
+func (p *SofficePool) takeIdle() *sofficeInstance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) == 0 {
+		return nil
+	}
+	inst := p.idle[0]
+	p.idle = p.idle[1:]
+	if len(p.idle) > 0 {
+		// Let another waiting caller take the next one
+		select {
+		case p.ready <- struct{}{}:
+		default:
+		}
+	}
+	return inst
+}
+
+// removeIdle drops inst from the idle set after its process exited.
+func (p *SofficePool) removeIdle(inst *sofficeInstance) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, idle := range p.idle {
+		if idle == inst {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+// acquire returns a healthy idle instance, waiting until one is released.
+func (p *SofficePool) acquire(ctx context.Context) (*sofficeInstance, error) {
+	for {
+		if !p.Available() {
+			return nil, errors.New("soffice pool unavailable")
+		}
+
+		if inst := p.takeIdle(); inst != nil {
+			if inst.healthy() {
+				return inst, nil
+			}
+			p.logger.Warn("discarding unhealthy soffice instance", "slot", inst.slot)
+			inst.kill()
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-p.ctx.Done():
+			return nil, errors.New("soffice pool closed")
+		case <-p.ready:
+		case <-time.After(queuePollInterval):
+			// Re-check availability in case every instance died meanwhile
+		}
+	}
+}
+
+// release returns inst to the pool, recycling it once it reached the
+// configured number of conversions.
+func (p *SofficePool) release(inst *sofficeInstance) {
+	inst.conversions++
+	if p.config.MaxConversions > 0 && inst.conversions >= p.config.MaxConversions {
+		p.logger.Info("recycling soffice instance",
+			"slot", inst.slot,
+			"conversions", inst.conversions,
+		)
+		inst.kill()
+		return
+	}
+	p.putIdle(inst)
+}
+
+// convert asks inst to convert input into outPath through unoserver's
+// XML-RPC convert method.
+func (i *sofficeInstance) convert(ctx context.Context, input, outPath string, format OutputFormat) error {
+	convertTo, filterName, filterOptions := splitFilter(format.Filter)
+
+	options := []string{}
+	if filterOptions != "" {
+		options = append(options, filterOptions)
+	}
+
+	// convert(inpath, indata, outpath, convert_to, filtername,
+	//         filter_options, update_index, infiltername)
+	body, err := xmlrpcCall("convert",
+		input, nil, outPath, convertTo, filterName, options, true, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+i.addr()+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unoserver returned %s", resp.Status)
+	}
+	return xmlrpcFault(resp.Body)
+}
+
+// splitFilter splits a --convert-to argument such as "html:HTML:EmbedImages"
+// into extension, filter name and filter options.
+func splitFilter(filter string) (string, string, string) {
+	parts := strings.SplitN(filter, ":", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// xmlrpcCall encodes an XML-RPC method call. Supported parameter types are
+// nil, string, bool and []string.
+func xmlrpcCall(method string, params ...any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?><methodCall><methodName>`)
+	xml.EscapeText(&buf, []byte(method))
+	buf.WriteString(`</methodName><params>`)
+	for _, param := range params {
+		buf.WriteString(`<param><value>`)
+		switch v := param.(type) {
+		case nil:
+			buf.WriteString(`<nil/>`)
+		case string:
+			buf.WriteString(`<string>`)
+			xml.EscapeText(&buf, []byte(v))
+			buf.WriteString(`</string>`)
+		case bool:
+			if v {
+				buf.WriteString(`<boolean>1</boolean>`)
+			} else {
+				buf.WriteString(`<boolean>0</boolean>`)
+			}
+		case []string:
+			buf.WriteString(`<array><data>`)
+			for _, item := range v {
+				buf.WriteString(`<value><string>`)
+				xml.EscapeText(&buf, []byte(item))
+				buf.WriteString(`</string></value>`)
+			}
+			buf.WriteString(`</data></array>`)
+		default:
+			return nil, fmt.Errorf("unsupported xml-rpc parameter type %T", param)
+		}
+		buf.WriteString(`</value></param>`)
+	}
+	buf.WriteString(`</params></methodCall>`)
+	return buf.Bytes(), nil
+}
+
+// xmlrpcFault returns the faultString of an XML-RPC fault response, or nil
+// when the response is not a fault.
+func xmlrpcFault(r io.Reader) error {
+	var response struct {
+		Fault *struct {
+			Members []struct {
+				Name  string `xml:"name"`
+				Value struct {
+					String string `xml:"string"`
+					Inner  string `xml:",chardata"`
+				} `xml:"value"`
+			} `xml:"value>struct>member"`
+		} `xml:"fault"`
+	}
+	if err := xml.NewDecoder(r).Decode(&response); err != nil {
+		return fmt.Errorf("decode unoserver response: %w", err)
+	}
+	if response.Fault == nil {
+		return nil
+	}
+	for _, member := range response.Fault.Members {
+		if member.Name == "faultString" {
+			msg := member.Value.String
+			if msg == "" {
+				msg = strings.TrimSpace(member.Value.Inner)
+			}
+			return errors.New(msg)
+		}
+	}
+	return errors.New("unoserver returned a fault")
+}
+
+// PooledBackend converts through a SofficePool and falls back to one-shot
+// LibreOffice runs when the pool has no running instance.
+type PooledBackend struct {
+	pool     *SofficePool
+	fallback Backend
+	logger   *slog.Logger
+}
+
+func NewPooledBackend(pool *SofficePool, fallback Backend, logger *slog.Logger) *PooledBackend {
+	return &PooledBackend{
+		pool:     pool,
+		fallback: fallback,
+		logger:   logger,
+	}
+}
+
+func (b *PooledBackend) Convert(ctx context.Context, input, outputDir string, opts ConvertOptions) ([]Artifact, error) {
+	inst, err := b.pool.acquire(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		b.logger.Warn("soffice pool unavailable, using one-shot conversion",
+			"error", err,
+			"job_id", opts.JobID,
+		)
+		return b.fallback.Convert(ctx, input, outputDir, opts)
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	convertedFile := filepath.Join(outputDir, baseName+opts.Format.Extension)
+
+	start := time.Now()
+	err = inst.convert(ctx, input, convertedFile, opts.Format)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The instance may be stuck on this document; replace it
+			inst.kill()
+			return nil, err
+		}
+
+		b.logger.Error("pooled conversion failed",
+			"error", err,
+			"slot", inst.slot,
+			"job_id", opts.JobID,
+		)
+		if !inst.healthy() {
+			// The instance crashed on this document; its supervisor restarts it
+			return nil, &ConversionError{
+				Code:    ErrorCodeConversionFailed,
+				Message: "LibreOffice crashed during conversion",
+				Err:     err,
+			}
+		}
+		b.pool.release(inst)
+		return nil, &ConversionError{
+			Code:    ErrorCodeConversionFailed,
+			Message: "Conversion failed",
+			Err:     err,
+		}
+	}
+	b.pool.release(inst)
+
+	b.logger.Info("pooled conversion completed",
+		"slot", inst.slot,
+		"duration_ms", time.Since(start).Milliseconds(),
+		"job_id", opts.JobID,
+	)
+
+	if _, err := os.Stat(convertedFile); os.IsNotExist(err) {
+		b.logger.Error("converted file not found after conversion",
+			"expected_file", convertedFile,
+			"job_id", opts.JobID,
+		)
+		return nil, &ConversionError{
+			Code:    ErrorCodeConversionFailed,
+			Message: "Converted file not found after conversion",
+			Err:     err,
+		}
+	}
+
+	return []Artifact{{Path: convertedFile, MimeType: opts.Format.MimeType}}, nil
+}
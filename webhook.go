@@ -0,0 +1,454 @@
+// webhook.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"document-converter/services"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statuses of webhook deliveries
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Events sent to the callback_url of a job when processing finishes
+const (
+	EventJobCompleted = "job.completed"
+	EventJobFailed    = "job.failed"
+	EventJobRejected  = "job.rejected"
+)
+
+// Signature headers of webhook requests. The signature is the hex
+// HMAC-SHA256, keyed with the owner's webhook secret, of the timestamp, a dot
+// and the request body.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookIDHeader        = "X-Webhook-Id"
+	webhookEventHeader     = "X-Webhook-Event"
+)
+
+const (
+	// DefaultWebhookMaxAttempts bounds the attempts of a delivery unless
+	// WEBHOOK_MAX_ATTEMPTS overrides it
+	DefaultWebhookMaxAttempts = 8
+	// webhookTimeout bounds a single attempt
+	webhookTimeout = 10 * time.Second
+	// webhookBaseBackoff is the delay after the first failed attempt; it
+	// doubles after each further failure up to webhookMaxBackoff
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+	// webhookConcurrency is the number of deliveries attempted at once
+	webhookConcurrency = 4
+	// maxCallbackURLLength bounds the callback_url of a job
+	maxCallbackURLLength = 2048
+)
+
+// webhookSecretPrefix marks webhook secrets.
+const webhookSecretPrefix = "whsec_"
+
+// WebhookEvent is the JSON body of a webhook request.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Job       JobResponse `json:"job"`
+}
+
+// Webhooks delivers the callbacks of finished jobs from the
+// webhook_deliveries table, retrying failed attempts with exponential
+// backoff.
+type Webhooks struct {
+	db          *services.DB
+	logger      *slog.Logger
+	client      *http.Client
+	maxAttempts int
+	signal      chan struct{}
+}
+
+// NewWebhooks returns a dispatcher. Unless allowPrivate is set, callbacks to
+// loopback, private and link-local addresses are refused.
+func NewWebhooks(db *services.DB, logger *slog.Logger, maxAttempts int, allowPrivate bool) *Webhooks {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		// Checked after name resolution, so DNS names cannot point elsewhere
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !publicIP(ip) {
+				return fmt.Errorf("callback address %s is not public", host)
+			}
+			return nil
+		}
+	}
+
+	return &Webhooks{
+		db:     db,
+		logger: logger,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: webhookTimeout,
+				MaxIdleConns:        webhookConcurrency,
+			},
+			// A redirect is an unsuccessful attempt
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		maxAttempts: max(maxAttempts, 1),
+		signal:      make(chan struct{}, 1),
+	}
+}
+
+// specialPurposePrefixes are the ranges of the IANA special-purpose address
+// registries that are not globally reachable, beyond the private, loopback
+// and link-local ones publicIP checks separately.
+var specialPurposePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT)
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1
+	netip.MustParsePrefix("192.88.99.0/24"),  // deprecated 6to4 relay anycast
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, may embed private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, may embed private IPv4
+	netip.MustParsePrefix("3fff::/20"),       // documentation
+	netip.MustParsePrefix("5f00::/16"),       // segment routing SIDs
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+}
+
+// publicIP reports whether ip is a globally routable unicast address.
+// IPv4-mapped IPv6 addresses are checked as the IPv4 address they map.
+func publicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range specialPurposePrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateCallbackURL checks the callback_url form field of a job.
+func validateCallbackURL(raw string) error {
+	if len(raw) > maxCallbackURLLength {
+		return fmt.Errorf("callback_url is longer than %d bytes", maxCallbackURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("callback_url must not contain credentials")
+	}
+	return nil
+}
+
+// webhookEventType returns the event sent for a job in status, if any.
+func webhookEventType(status string) (string, bool) {
+	switch status {
+	case StatusComplete:
+		return EventJobCompleted, true
+	case StatusFailed:
+		return EventJobFailed, true
+	case StatusRejected:
+		return EventJobRejected, true
+	}
+	return "", false
+}
+
+// enqueueWebhook stores the callback of a finished job for delivery. Jobs
+// without a callback_url are ignored.
+func (s *Server) enqueueWebhook(job *services.ConvertJob) {
+	if s.webhooks == nil || job.CallbackURL == "" {
+		return
+	}
+	eventType, ok := webhookEventType(job.Status)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	event := WebhookEvent{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: now,
+		Job:       JobResponse{ConvertJob: job, Links: jobLinks(job)},
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Error("failed to marshal webhook event", "error", err, "job_id", job.ID)
+		return
+	}
+
+	delivery := &services.WebhookDelivery{
+		ID:            event.ID,
+		JobID:         job.ID,
+		Owner:         job.Owner,
+		URL:           job.CallbackURL,
+		Event:         eventType,
+		Payload:       payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.db.CreateDelivery(delivery); err != nil {
+		s.logger.Error("failed to store webhook delivery",
+			"error", err,
+			"job_id", job.ID,
+		)
+		return
+	}
+
+	s.logger.Info("webhook queued",
+		"delivery_id", delivery.ID,
+		"job_id", job.ID,
+		"event", eventType,
+	)
+	s.webhooks.notify()
+}
+
+func (wh *Webhooks) notify() {
+	select {
+	case wh.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due webhooks until ctx is cancelled. Deliveries left pending
+// by a previous run are picked up as well.
+func (wh *Webhooks) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		for wh.deliverDue(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wh.signal:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue attempts a batch of due deliveries. It reports whether the batch
+// was full, so more deliveries may be due.
+func (wh *Webhooks) deliverDue(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	now := time.Now()
+	// Lease the batch beyond the time its attempts can take
+	deliveries, err := wh.db.ClaimDueDeliveries(DeliveryPending, now, now.Add(2*webhookTimeout), webhookConcurrency)
+	if err != nil {
+		wh.logger.Error("failed to claim webhook deliveries", "error", err)
+		return false
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wh.attempt(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+
+	return len(deliveries) == webhookConcurrency
+}
+
+// attempt sends a delivery once and records the outcome.
+func (wh *Webhooks) attempt(ctx context.Context, delivery *services.WebhookDelivery) {
+	statusCode, err := wh.send(ctx, delivery)
+	if ctx.Err() != nil {
+		// Shutting down; the lease expires and the next run retries
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastStatusCode = statusCode
+	delivery.UpdatedAt = time.Now()
+
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+		wh.logger.Info("webhook delivered",
+			"delivery_id", delivery.ID,
+			"job_id", delivery.JobID,
+			"attempts", delivery.Attempts,
+		)
+	case delivery.Attempts >= wh.maxAttempts || errors.Is(err, errDeliveryAbandoned):
+		delivery.Status = DeliveryFailed
+		delivery.LastError = err.Error()
+		wh.logger.Warn("webhook delivery failed permanently",
+			"error", err,
+			"delivery_id", delivery.ID,
+			"job_id", delivery.JobID,
+			"attempts", delivery.Attempts,
+		)
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = delivery.UpdatedAt.Add(webhookBackoff(delivery.Attempts))
+		wh.logger.Warn("webhook delivery failed, retrying",
+			"error", err,
+			"delivery_id", delivery.ID,
+			"job_id", delivery.JobID,
+			"attempts", delivery.Attempts,
+			"next_attempt_at", delivery.NextAttemptAt,
+		)
+	}
+
+	if err := wh.db.UpdateDelivery(delivery); err != nil {
+		wh.logger.Error("failed to update webhook delivery",
+			"error", err,
+			"delivery_id", delivery.ID,
+		)
+	}
+}
+
+// errDeliveryAbandoned fails a delivery without further attempts.
+var errDeliveryAbandoned = errors.New("delivery abandoned")
+
+// send posts the signed payload of delivery and returns the response status.
+func (wh *Webhooks) send(ctx context.Context, delivery *services.WebhookDelivery) (int, error) {
+	secret, err := webhookSecret(wh.db, delivery.Owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: API key of the job was revoked", errDeliveryAbandoned)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errDeliveryAbandoned, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "document-converter-webhook")
+	req.Header.Set(webhookIDHeader, delivery.ID)
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(secret, timestamp, delivery.Payload))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("callback responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of timestamp, a dot and payload.
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns the delay after the given number of failed attempts.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+// webhookSecret returns the webhook secret of an API key, generating it on
+// first use.
+func webhookSecret(db *services.DB, keyID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return db.EnsureWebhookSecret(keyID, webhookSecretPrefix+base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (s *Server) handleGetWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	secret, err := webhookSecret(s.db, caller(r).ID)
+	if err != nil {
+		s.logger.Error("failed to get webhook secret", "error", err, "key_id", caller(r).ID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+}
+
+func (s *Server) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	job, err := s.db.GetJob(id)
+	if err != nil || !canAccess(caller(r), job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := s.db.GetJobDeliveries(id)
+	if err != nil {
+		s.logger.Error("failed to get webhook deliveries", "error", err, "job_id", id)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*services.WebhookDelivery{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
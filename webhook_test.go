@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"document-converter/services"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"::ffff:8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"192.0.0.8", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"198.51.100.1", false},
+		{"203.0.113.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:100.64.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"2001:db8::1", false},
+		{"2002:a00:1::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// webhookRequest is a request received by a test callback.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// callbackServer records webhook requests and answers them with the given
+// statuses in turn, then with 200.
+func callbackServer(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, webhookRequest{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if n := len(received); n <= len(statuses) {
+			status = statuses[n-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), received...)
+	}
+}
+
+// uploadWithCallback posts a document whose result is posted to callbackURL
+// and converts it.
+func (ts *testServer) uploadWithCallback(t *testing.T, callbackURL string) string {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "report.docx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(makeDocx(t, "hello"))
+	mw.WriteField("target_format", "pdf")
+	mw.WriteField("callback_url", callbackURL)
+	mw.Close()
+
+	resp := ts.do(t, http.MethodPost, "/converts", &body, mw.FormDataContentType())
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /converts: status %d", resp.StatusCode)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	ts.work(t)
+	return created.ID
+}
+
+// delivery returns the only webhook delivery of a job.
+func (ts *testServer) delivery(t *testing.T, jobID string) *services.WebhookDelivery {
+	t.Helper()
+	deliveries, err := ts.db.GetJobDeliveries(jobID)
+	if err != nil {
+		t.Fatalf("GetJobDeliveries: %v", err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestWebhookDeliverySignedAndRetried(t *testing.T) {
+	ts := newTestServer(t)
+	ts.webhooks = NewWebhooks(ts.db, ts.logger, 3, true)
+	callback, received := callbackServer(t, http.StatusInternalServerError)
+
+	id := ts.uploadWithCallback(t, callback.URL)
+	ts.webhooks.deliverDue(context.Background())
+
+	// A failed attempt is retried after the backoff
+	delivery := ts.delivery(t, id)
+	if delivery.Status != DeliveryPending || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("after a 500: %s with %d attempts and status code %d, want pending with 1 and 500",
+			delivery.Status, delivery.Attempts, delivery.LastStatusCode)
+	}
+	if !delivery.NextAttemptAt.After(time.Now()) {
+		t.Errorf("next attempt at %s, want after the backoff", delivery.NextAttemptAt)
+	}
+	ts.webhooks.deliverDue(context.Background())
+	if n := len(received()); n != 1 {
+		t.Fatalf("attempted %d times before the backoff passed, want 1", n)
+	}
+
+	delivery.NextAttemptAt = time.Now()
+	if err := ts.db.UpdateDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	ts.webhooks.deliverDue(context.Background())
+	if delivery := ts.delivery(t, id); delivery.Status != DeliveryDelivered || delivery.Attempts != 2 {
+		t.Errorf("after a 200: %s with %d attempts, want delivered with 2", delivery.Status, delivery.Attempts)
+	}
+
+	requests := received()
+	if len(requests) != 2 {
+		t.Fatalf("callback received %d requests, want 2", len(requests))
+	}
+	req := requests[1]
+
+	// The signature is sha256=HMAC(secret, timestamp "." body)
+	var secret struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(ts.do(t, http.MethodGet, "/webhook-secret", nil, "").Body).Decode(&secret); err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret.Secret))
+	mac.Write([]byte(req.header.Get(webhookTimestampHeader) + "."))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.header.Get(webhookSignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("%s = %q, want %q", webhookSignatureHeader, got, want)
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(req.body, &event); err != nil {
+		t.Fatalf("decoding webhook body: %v", err)
+	}
+	if event.Type != EventJobCompleted || event.Job.ID != id {
+		t.Errorf("event %s for job %s, want %s for %s", event.Type, event.Job.ID, EventJobCompleted, id)
+	}
+	if got := req.header.Get(webhookEventHeader); got != EventJobCompleted {
+		t.Errorf("%s = %q, want %q", webhookEventHeader, got, EventJobCompleted)
+	}
+	if got := req.header.Get(webhookIDHeader); got != event.ID {
+		t.Errorf("%s = %q, want the event id %q", webhookIDHeader, got, event.ID)
+	}
+}
+
+func TestWebhookRefusesNonPublicAddresses(t *testing.T) {
+	callback, received := callbackServer(t)
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"loopback", callback.URL},
+		{"localhost", strings.Replace(callback.URL, "127.0.0.1", "localhost", 1)},
+		{"shared address space", "http://100.64.0.1:8080/hook"},
+		{"mapped loopback", "http://[::ffff:127.0.0.1]:8080/hook"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.webhooks = NewWebhooks(ts.db, ts.logger, 1, false)
+
+			id := ts.uploadWithCallback(t, tt.url)
+			ts.webhooks.deliverDue(context.Background())
+
+			delivery := ts.delivery(t, id)
+			if delivery.Status != DeliveryFailed || !strings.Contains(delivery.LastError, "is not public") {
+				t.Errorf("delivery %s with error %q, want failed as not public", delivery.Status, delivery.LastError)
+			}
+		})
+	}
+	if n := len(received()); n != 0 {
+		t.Errorf("callback on loopback received %d requests", n)
+	}
+}
@@ -0,0 +1,512 @@
+// websocket.go
+package main
+
+import (
+	"document-converter/services"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsSendBufferSize is the number of messages queued per client; clients
+	// falling further behind are disconnected
+	wsSendBufferSize = 64
+	// wsWriteWait bounds the time of writing a message to a client
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may stay silent, including pongs,
+	// before it is considered dead
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod must be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsMaxMessageSize bounds the messages read from clients
+	wsMaxMessageSize = 4096
+	// wsMaxSubscriptions bounds the job IDs and owners a client subscribes to
+	wsMaxSubscriptions = 1000
+)
+
+// Commands accepted from WebSocket clients
+const (
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandCancel      = "cancel"
+	CommandRetry       = "retry"
+)
+
+// Error codes of refused WebSocket commands, besides the quota codes
+const (
+	ErrorCodeInvalidCommand = "invalid_command"
+	ErrorCodeNotFound       = "not_found"
+	ErrorCodeConflict       = "conflict"
+	ErrorCodeUnavailable    = "unavailable"
+)
+
+// allOwners subscribes admins to the jobs of every owner.
+const allOwners = "*"
+
+// WebSocketCommand is a command sent by a WebSocket client. RequestID is
+// echoed in the reply so clients can match them up.
+type WebSocketCommand struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+	// JobIDs and Owners select the jobs of subscribe and unsubscribe
+	JobIDs []string `json:"job_ids,omitempty"`
+	Owners []string `json:"owners,omitempty"`
+	// JobID is the job to cancel or retry
+	JobID string `json:"job_id,omitempty"`
+}
+
+// WebSocketSubscription lists the job IDs and owners a client is subscribed to.
+type WebSocketSubscription struct {
+	JobIDs []string `json:"job_ids"`
+	Owners []string `json:"owners"`
+}
+
+// WebSocketAck acknowledges a command. Subscription is set for subscribe and
+// unsubscribe, Payload for cancel and retry.
+type WebSocketAck struct {
+	Type         string                 `json:"type"`
+	Command      string                 `json:"command"`
+	RequestID    string                 `json:"request_id,omitempty"`
+	Subscription *WebSocketSubscription `json:"subscription,omitempty"`
+	Payload      *JobResponse           `json:"payload,omitempty"`
+}
+
+// WebSocketError reports a refused command.
+type WebSocketError struct {
+	Type      string `json:"type"`
+	Command   string `json:"command,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	ErrorCode string `json:"error_code"`
+	Error     string `json:"error"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true // In production, you might want to be more restrictive
+	},
+}
+
+// ClientConnection is a WebSocket client. Messages are queued on send and
+// written by the writer goroutine of the client, so a slow client never holds
+// up the others.
+type ClientConnection struct {
+	conn *websocket.Conn
+	send chan wsMessage
+
+	// key authenticated the connection; only its jobs are sent
+	key *services.APIKey
+
+	// jobIDs and owners select the events sent to the client
+	subMu  sync.Mutex
+	jobIDs map[string]bool
+	owners map[string]bool
+
+	// done is closed to make the writer close the connection with closeCode
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+// wsMessage is a message queued for a client. seq is the sequence number of
+// events and zero for command replies.
+type wsMessage struct {
+	seq  uint64
+	data []byte
+}
+
+// newClientConnection returns a client subscribed to the jobs of key, or to
+// every job for admin keys.
+func newClientConnection(conn *websocket.Conn, key *services.APIKey) *ClientConnection {
+	owner := key.ID
+	if key.Role == RoleAdmin {
+		owner = allOwners
+	}
+	return &ClientConnection{
+		conn:   conn,
+		send:   make(chan wsMessage, wsSendBufferSize),
+		key:    key,
+		jobIDs: make(map[string]bool),
+		owners: map[string]bool{owner: true},
+		done:   make(chan struct{}),
+	}
+}
+
+// wants reports whether the client is subscribed to e. Subscriptions to a
+// job end with its deletion.
+func (c *ClientConnection) wants(e Event) bool {
+	if !canAccessOwner(c.key, e.Owner) {
+		return false
+	}
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if c.owners[allOwners] || c.owners[e.Owner] {
+		return true
+	}
+	if !c.jobIDs[e.JobID] {
+		return false
+	}
+	if e.Type == EventJobDelete {
+		delete(c.jobIDs, e.JobID)
+	}
+	return true
+}
+
+// subscription returns the current subscription of the client.
+func (c *ClientConnection) subscription() *WebSocketSubscription {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	sub := &WebSocketSubscription{JobIDs: []string{}, Owners: []string{}}
+	for id := range c.jobIDs {
+		sub.JobIDs = append(sub.JobIDs, id)
+	}
+	for owner := range c.owners {
+		sub.Owners = append(sub.Owners, owner)
+	}
+	slices.Sort(sub.JobIDs)
+	slices.Sort(sub.Owners)
+	return sub
+}
+
+// enqueue queues message for the client without blocking. It reports false
+// when the buffer of the client is full; messages for closing clients are
+// dropped.
+func (c *ClientConnection) enqueue(message wsMessage) bool {
+	select {
+	case <-c.done:
+		return true
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// close makes the writer send a close frame with code and reason and close
+// the connection. Only the first call has an effect.
+func (c *ClientConnection) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// handleWebSocket serves a WebSocket client. Clients reconnecting with the
+// after parameter first receive the recorded events following that sequence
+// number.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	resume := r.URL.Query().Has("after")
+	if resume {
+		var err error
+		if after, err = strconv.ParseUint(r.URL.Query().Get("after"), 10, 64); err != nil {
+			http.Error(w, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error("websocket upgrade failed", "error", err)
+		return
+	}
+
+	client := newClientConnection(conn, caller(r))
+
+	s.clientsMu.Lock()
+	s.clients[client] = true
+	s.clientsMu.Unlock()
+
+	writerDone := make(chan struct{})
+	go func() {
+		s.writeWebSocket(client, resume, after)
+		close(writerDone)
+	}()
+
+	defer func() {
+		s.clientsMu.Lock()
+		delete(s.clients, client)
+		s.clientsMu.Unlock()
+
+		client.close(websocket.CloseNormalClosure, "")
+		<-writerDone
+	}()
+
+	// Pongs answer the pings of the writer and keep the connection alive
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				s.logger.Error("websocket error", "error", err)
+			}
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var command WebSocketCommand
+		if err := json.Unmarshal(message, &command); err != nil {
+			s.replyWebSocket(client, &WebSocketError{
+				Type:      "error",
+				ErrorCode: ErrorCodeInvalidCommand,
+				Error:     "Commands must be JSON objects",
+			})
+			continue
+		}
+		s.handleWebSocketCommand(client, &command)
+	}
+}
+
+// handleWebSocketCommand runs a command of client and replies with an ack or
+// an error.
+func (s *Server) handleWebSocketCommand(client *ClientConnection, command *WebSocketCommand) {
+	ack := &WebSocketAck{
+		Type:      "ack",
+		Command:   command.Type,
+		RequestID: command.RequestID,
+	}
+
+	var err error
+	switch command.Type {
+	case CommandSubscribe:
+		err = s.subscribeClient(client, command.JobIDs, command.Owners)
+		ack.Subscription = client.subscription()
+	case CommandUnsubscribe:
+		client.unsubscribe(command.JobIDs, command.Owners)
+		ack.Subscription = client.subscription()
+	case CommandCancel, CommandRetry:
+		var job *services.ConvertJob
+		if command.Type == CommandCancel {
+			job, err = s.cancelJob(client.key, command.JobID)
+		} else {
+			job, err = s.retryJob(client.key, command.JobID)
+		}
+		if err == nil {
+			ack.Payload = &JobResponse{ConvertJob: job, Links: jobLinks(job)}
+		}
+	default:
+		err = &commandError{Code: ErrorCodeInvalidCommand, Message: "Unknown command type"}
+	}
+
+	if err != nil {
+		code, message := commandErrorCode(err)
+		s.replyWebSocket(client, &WebSocketError{
+			Type:      "error",
+			Command:   command.Type,
+			RequestID: command.RequestID,
+			ErrorCode: code,
+			Error:     message,
+		})
+		return
+	}
+	s.replyWebSocket(client, ack)
+}
+
+// commandError refuses a WebSocket command with an error code.
+type commandError struct {
+	Code    string
+	Message string
+}
+
+func (e *commandError) Error() string {
+	return e.Message
+}
+
+// commandErrorCode returns the error code and message sent for err.
+func commandErrorCode(err error) (string, string) {
+	var cmdErr *commandError
+	var quotaErr *QuotaError
+	var actionErr *JobActionError
+	switch {
+	case errors.As(err, &cmdErr):
+		return cmdErr.Code, cmdErr.Message
+	case errors.As(err, &quotaErr):
+		return quotaErr.Code, quotaErr.Message
+	case errors.As(err, &actionErr):
+		switch actionErr.Status {
+		case http.StatusNotFound:
+			return ErrorCodeNotFound, actionErr.Message
+		case http.StatusConflict:
+			return ErrorCodeConflict, actionErr.Message
+		case http.StatusServiceUnavailable:
+			return ErrorCodeUnavailable, actionErr.Message
+		}
+	}
+	return ErrorCodeInternal, "Internal server error"
+}
+
+// subscribeClient adds job IDs and owners to the subscription of client.
+// Nothing is added when any of them is not accessible to the client.
+func (s *Server) subscribeClient(client *ClientConnection, jobIDs, owners []string) error {
+	for _, owner := range owners {
+		if client.key.Role != RoleAdmin && owner != client.key.ID {
+			return &commandError{Code: ErrorCodeForbidden, Message: "Only admin keys may subscribe to other owners"}
+		}
+	}
+	for _, id := range jobIDs {
+		if _, err := s.accessibleJob(client.key, id); err != nil {
+			var actionErr *JobActionError
+			if errors.As(err, &actionErr) {
+				return &commandError{Code: ErrorCodeNotFound, Message: "Job not found: " + id}
+			}
+			s.logger.Error("failed to get job for subscription", "error", err, "id", id)
+			return err
+		}
+	}
+
+	client.subMu.Lock()
+	defer client.subMu.Unlock()
+	if len(client.jobIDs)+len(client.owners)+len(jobIDs)+len(owners) > wsMaxSubscriptions {
+		return &commandError{Code: ErrorCodeInvalidCommand, Message: "Too many subscriptions"}
+	}
+	for _, id := range jobIDs {
+		client.jobIDs[id] = true
+	}
+	for _, owner := range owners {
+		client.owners[owner] = true
+	}
+	return nil
+}
+
+// unsubscribe removes job IDs and owners from the subscription of the client.
+func (c *ClientConnection) unsubscribe(jobIDs, owners []string) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	for _, id := range jobIDs {
+		delete(c.jobIDs, id)
+	}
+	for _, owner := range owners {
+		delete(c.owners, owner)
+	}
+}
+
+// replyWebSocket queues a reply for client, disconnecting it when its queue
+// is full.
+func (s *Server) replyWebSocket(client *ClientConnection, reply any) {
+	message, err := json.Marshal(reply)
+	if err != nil {
+		s.logger.Error("failed to marshal websocket reply", "error", err)
+		return
+	}
+	if !client.enqueue(wsMessage{data: message}) {
+		client.close(websocket.CloseTryAgainLater, "Too slow, reconnect")
+	}
+}
+
+// writeWebSocket writes the queued messages and keepalive pings of client
+// until it is closed, the server shuts down or a write fails. When resuming,
+// the recorded events after the given sequence number are written first. The
+// connection is closed on return, which also ends the reader.
+func (s *Server) writeWebSocket(client *ClientConnection, resume bool, after uint64) {
+	defer client.conn.Close()
+
+	// Events queued meanwhile that were replayed already are skipped
+	var replayed uint64
+	if resume {
+		query := eventQuery(client.key, "")
+		query.After = after
+		var writeErr error
+		var err error
+		replayed, err = s.replayEvents(query, client.wants, func(e Event) bool {
+			writeErr = s.writeWebSocketMessage(client, e.Data)
+			return writeErr == nil
+		})
+		if err != nil {
+			s.logger.Error("failed to replay job events", "error", err)
+		}
+		if writeErr != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case message := <-client.send:
+			if message.seq != 0 && message.seq <= replayed {
+				continue
+			}
+			if err := s.writeWebSocketMessage(client, message.data); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-client.done:
+			closeMessage := websocket.FormatCloseMessage(client.closeCode, client.closeReason)
+			client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(wsWriteWait))
+			return
+		case <-s.closeStreams:
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down")
+			client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(wsWriteWait))
+			return
+		}
+	}
+}
+
+// writeWebSocketMessage writes message to client within wsWriteWait.
+func (s *Server) writeWebSocketMessage(client *ClientConnection, message []byte) error {
+	client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	err := client.conn.WriteMessage(websocket.TextMessage, message)
+	if err != nil {
+		s.logger.Warn("failed to send websocket message", "error", err)
+	}
+	return err
+}
+
+// runWebSocketHub queues the events of the event bus for the WebSocket
+// clients allowed to see them. Clients whose queue is full are disconnected;
+// they reload their jobs when reconnecting.
+func (s *Server) runWebSocketHub() {
+	sub := s.events.subscribeLossless(func(Event) bool { return true })
+
+	for e := range sub.C {
+		s.clientsMu.RLock()
+		for client := range s.clients {
+			if !client.wants(e) {
+				continue
+			}
+			if !client.enqueue(wsMessage{seq: e.Seq, data: e.Data}) {
+				s.logger.Warn("websocket client too slow, disconnecting",
+					"key_id", client.key.ID,
+					"type", e.Type,
+				)
+				client.close(websocket.CloseTryAgainLater, "Too slow, reconnect")
+			}
+		}
+		s.clientsMu.RUnlock()
+	}
+}
+
+// disconnectKey closes the WebSocket connections authenticated by a revoked
+// key.
+func (s *Server) disconnectKey(keyID string) {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	for client := range s.clients {
+		if client.key != nil && client.key.ID == keyID {
+			client.close(websocket.ClosePolicyViolation, "API key revoked")
+		}
+	}
+}
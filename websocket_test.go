@@ -0,0 +1,150 @@
+package main
+
+import (
+	"document-converter/services"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsReply is an ack or error reply to a WebSocket command.
+type wsReply struct {
+	Type         string                 `json:"type"`
+	Command      string                 `json:"command"`
+	RequestID    string                 `json:"request_id"`
+	ErrorCode    string                 `json:"error_code"`
+	Subscription *WebSocketSubscription `json:"subscription"`
+	Payload      *JobResponse           `json:"payload"`
+}
+
+// dialWebSocket connects to /ws with the key of ts.
+func (ts *testServer) dialWebSocket(t *testing.T) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.http.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + ts.key}})
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// sendCommand sends command and returns its reply, skipping job events.
+func sendCommand(t *testing.T, conn *websocket.Conn, command any) wsReply {
+	t.Helper()
+	if err := conn.WriteJSON(command); err != nil {
+		t.Fatalf("sending websocket command: %v", err)
+	}
+	for {
+		var reply wsReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("reading websocket reply: %v", err)
+		}
+		if reply.Type == "ack" || reply.Type == "error" {
+			return reply
+		}
+	}
+}
+
+func TestWebSocketCancelAndRetry(t *testing.T) {
+	ts := newTestServer(t)
+	go ts.runWebSocketHub()
+	conn := ts.dialWebSocket(t)
+
+	queued := ts.upload(t, "queued.docx", makeDocx(t, "queued"), "pdf")
+	reply := sendCommand(t, conn, WebSocketCommand{Type: CommandCancel, RequestID: "cancel-1", JobID: queued})
+	if reply.Type != "ack" || reply.Command != CommandCancel || reply.RequestID != "cancel-1" {
+		t.Fatalf("cancel reply %+v, want an ack echoing cancel-1", reply)
+	}
+	if reply.Payload == nil || reply.Payload.ID != queued || reply.Payload.Status != StatusCancelled {
+		t.Errorf("cancel payload %+v, want the cancelled job", reply.Payload)
+	}
+
+	// Finished jobs cannot be cancelled again
+	reply = sendCommand(t, conn, WebSocketCommand{Type: CommandCancel, RequestID: "cancel-2", JobID: queued})
+	if reply.Type != "error" || reply.ErrorCode != ErrorCodeConflict || reply.RequestID != "cancel-2" {
+		t.Errorf("second cancel reply %+v, want a conflict echoing cancel-2", reply)
+	}
+
+	ts.backend.Err = errors.New("fake failure")
+	failed := ts.upload(t, "failed.docx", makeDocx(t, "failed"), "pdf")
+	ts.work(t)
+	ts.backend.Err = nil
+
+	reply = sendCommand(t, conn, WebSocketCommand{Type: CommandRetry, RequestID: "retry-1", JobID: failed})
+	if reply.Type != "ack" || reply.Command != CommandRetry || reply.RequestID != "retry-1" {
+		t.Fatalf("retry reply %+v, want an ack echoing retry-1", reply)
+	}
+	if reply.Payload == nil || reply.Payload.ID != failed || reply.Payload.Status != StatusQueued {
+		t.Errorf("retry payload %+v, want the queued job", reply.Payload)
+	}
+	ts.work(t)
+	if job := ts.getJob(t, failed); job.Status != StatusComplete {
+		t.Errorf("retried job is %q, want %q", job.Status, StatusComplete)
+	}
+
+	reply = sendCommand(t, conn, WebSocketCommand{Type: CommandRetry, RequestID: "retry-2", JobID: failed})
+	if reply.Type != "error" || reply.ErrorCode != ErrorCodeConflict {
+		t.Errorf("retry of complete job reply %+v, want a conflict", reply)
+	}
+}
+
+func TestWebSocketCommandErrors(t *testing.T) {
+	ts := newTestServer(t)
+	go ts.runWebSocketHub()
+	user := ts.as(ts.createKey(t, "user", RoleUser, services.Quotas{}).Key)
+	conn := user.dialWebSocket(t)
+
+	// A job of the admin does not exist for the user
+	other := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+
+	tests := []struct {
+		name    string
+		command WebSocketCommand
+		code    string
+	}{
+		{"unknown command", WebSocketCommand{Type: "pause", JobID: other}, ErrorCodeInvalidCommand},
+		{"cancel unknown job", WebSocketCommand{Type: CommandCancel, JobID: "missing"}, ErrorCodeNotFound},
+		{"cancel job of another owner", WebSocketCommand{Type: CommandCancel, JobID: other}, ErrorCodeNotFound},
+		{"retry job of another owner", WebSocketCommand{Type: CommandRetry, JobID: other}, ErrorCodeNotFound},
+		{"subscribe to job of another owner", WebSocketCommand{Type: CommandSubscribe, JobIDs: []string{other}}, ErrorCodeNotFound},
+		{"subscribe to another owner", WebSocketCommand{Type: CommandSubscribe, Owners: []string{bootstrapKeyID}}, ErrorCodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.command.RequestID = tt.name
+			reply := sendCommand(t, conn, tt.command)
+			if reply.Type != "error" || reply.ErrorCode != tt.code {
+				t.Errorf("reply %+v, want error %s", reply, tt.code)
+			}
+			if reply.Command != tt.command.Type || reply.RequestID != tt.name {
+				t.Errorf("reply to %s echoes %s and %q", tt.command.Type, reply.Command, reply.RequestID)
+			}
+		})
+	}
+
+	if job := ts.getJob(t, other); job.Status != StatusQueued {
+		t.Errorf("job of another owner is %q, want %q", job.Status, StatusQueued)
+	}
+
+	// Malformed commands are refused without closing the connection
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	var reply wsReply
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("reading websocket reply: %v", err)
+	}
+	if reply.Type != "error" || reply.ErrorCode != ErrorCodeInvalidCommand {
+		t.Errorf("reply to malformed command %+v, want error %s", reply, ErrorCodeInvalidCommand)
+	}
+	reply = sendCommand(t, conn, WebSocketCommand{Type: CommandUnsubscribe, RequestID: "after"})
+	if reply.Type != "ack" || reply.RequestID != "after" {
+		t.Errorf("reply after malformed command %+v, want an ack", reply)
+	}
+}
@@ -0,0 +1,227 @@
+// worker.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"document-converter/services"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// queuePollInterval is how often idle workers look for queued jobs they were
+// not notified about, e.g. jobs left queued by a previous run.
+const queuePollInterval = 5 * time.Second
+
+// errJobCancelled is the cancellation cause of jobs cancelled through the API.
+var errJobCancelled = errors.New("job cancelled")
+
+// errServerShutdown is the cancellation cause of jobs that did not finish
+// within the drain timeout.
+var errServerShutdown = errors.New("server shutting down")
+
+// shutdownRetryAfter is the Retry-After value, in seconds, sent to clients
+// whose conversions are refused during shutdown.
+const shutdownRetryAfter = "30"
+
+// DefaultDrainTimeout is how long shutdown waits for running conversions
+// unless DRAIN_TIMEOUT overrides it.
+const DefaultDrainTimeout = 60 * time.Second
+
+// drainKillTimeout bounds the wait for conversions to stop after they were
+// cancelled at the end of the drain timeout.
+const drainKillTimeout = 15 * time.Second
+
+// trackJob registers a job as running and returns the context its conversion
+// runs under. The returned function must be called once the job is done.
+func (s *Server) trackJob(jobID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	s.runningMu.Lock()
+	s.running[jobID] = cancel
+	s.runningMu.Unlock()
+
+	return ctx, func() {
+		s.runningMu.Lock()
+		delete(s.running, jobID)
+		s.runningMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelRunningJob stops the conversion of a running job.
+func (s *Server) cancelRunningJob(jobID string) bool {
+	s.runningMu.Lock()
+	cancel, ok := s.running[jobID]
+	s.runningMu.Unlock()
+
+	if ok {
+		cancel(errJobCancelled)
+	}
+	return ok
+}
+
+// stopIfInterrupted finishes a job whose context was cancelled through the
+// API or by shutdown, and reports whether it did.
+func (s *Server) stopIfInterrupted(ctx context.Context, jobID string) bool {
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errJobCancelled):
+		s.logger.Info("conversion cancelled", "job_id", jobID)
+		s.removeJobDir(jobID)
+		return true
+	case errors.Is(cause, errServerShutdown):
+		s.logger.Info("conversion interrupted by shutdown", "job_id", jobID)
+		s.requeueJob(jobID, StatusProcessing)
+		return true
+	}
+	return false
+}
+
+// beginShutdown makes the server refuse new conversions.
+func (s *Server) beginShutdown() {
+	s.shuttingDown.Store(true)
+}
+
+// drainJobs waits until ctx is done for the workers to finish their current
+// conversions after their context was cancelled. Conversions still running
+// afterwards are killed and their jobs queued again for the next start.
+func (s *Server) drainJobs(ctx context.Context, workersDone <-chan struct{}) {
+	s.runningMu.Lock()
+	running := len(s.running)
+	s.runningMu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	s.logger.Info("draining running conversions",
+		"running", running,
+		"timeout", time.Until(deadline).Round(time.Second),
+	)
+
+	select {
+	case <-workersDone:
+		return
+	case <-ctx.Done():
+	}
+
+	s.runningMu.Lock()
+	for jobID, cancel := range s.running {
+		s.logger.Warn("conversion did not finish before shutdown", "job_id", jobID)
+		cancel(errServerShutdown)
+	}
+	s.runningMu.Unlock()
+
+	select {
+	case <-workersDone:
+	case <-time.After(drainKillTimeout):
+		s.logger.Error("workers did not stop after cancelling their conversions")
+	}
+}
+
+// requeueJob discards the partial output of a job and queues it again. It
+// reports whether the job was still in status from.
+func (s *Server) requeueJob(jobID, from string) bool {
+	convertedDir := filepath.Join(s.converter.tempDir, jobID, "converted")
+	err := os.RemoveAll(convertedDir)
+	if err == nil {
+		err = os.MkdirAll(convertedDir, 0755)
+	}
+	if err != nil {
+		s.logger.Error("failed to reset converted directory",
+			"error", err,
+			"path", convertedDir,
+		)
+	}
+
+	requeued := &services.ConvertJob{
+		ID:        jobID,
+		Status:    StatusQueued,
+		UpdatedAt: time.Now(),
+	}
+	updated, err := s.db.UpdateJobFrom(requeued, from)
+	if err != nil {
+		s.logger.Error("failed to requeue job",
+			"error", err,
+			"job_id", jobID,
+		)
+		return false
+	}
+	if !updated {
+		return false
+	}
+
+	s.logger.Info("requeued job",
+		"job_id", jobID,
+		"previous_status", from,
+	)
+
+	if job, err := s.db.GetJob(jobID); err == nil {
+		s.broadcastJobUpdate(job)
+	}
+	return true
+}
+
+// notifyWorkers wakes an idle worker to look for queued jobs.
+func (s *Server) notifyWorkers() {
+	select {
+	case s.queueSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runWorkers starts count workers that process queued jobs in creation order
+// and blocks until ctx is cancelled and every worker has returned.
+func (s *Server) runWorkers(ctx context.Context, count int) {
+	s.logger.Info("starting conversion workers", "count", count)
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			s.runWorker(ctx, workerID)
+		}(i + 1)
+	}
+	wg.Wait()
+
+	s.logger.Info("conversion workers stopped")
+}
+
+func (s *Server) runWorker(ctx context.Context, workerID int) {
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, err := s.db.ClaimNextJob(StatusQueued, StatusProcessing)
+		if err == nil {
+			// More jobs may be waiting; let another idle worker look
+			s.notifyWorkers()
+
+			s.logger.Info("worker claimed job",
+				"worker", workerID,
+				"job_id", job.ID,
+			)
+			s.processConversion(job)
+			continue
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			s.logger.Error("failed to claim queued job",
+				"error", err,
+				"worker", workerID,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.queueSignal:
+		case <-ticker.C:
+		}
+	}
+}
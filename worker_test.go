@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForStatus polls job id until it reaches status.
+func (ts *testServer) waitForStatus(t *testing.T, id, status string) JobResponse {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job := ts.getJob(t, id)
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %q, want %q", id, job.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClaimNextJobInCreationOrder(t *testing.T) {
+	ts := newTestServer(t)
+	var ids []string
+	for _, name := range []string{"first.docx", "second.docx", "third.docx"} {
+		ids = append(ids, ts.upload(t, name, makeDocx(t, name), "pdf"))
+	}
+
+	for _, want := range ids {
+		job, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing)
+		if err != nil {
+			t.Fatalf("ClaimNextJob: %v", err)
+		}
+		if job.ID != want || job.Status != StatusProcessing {
+			t.Errorf("claimed %s (%s), want %s (%s)", job.ID, job.Status, want, StatusProcessing)
+		}
+	}
+	if _, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("ClaimNextJob on an empty queue = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestClaimNextJobClaimsOnce(t *testing.T) {
+	ts := newTestServer(t)
+	const jobs, claimers = 5, 20
+	for i := 0; i < jobs; i++ {
+		ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < claimers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			claimed[job.ID]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != jobs {
+		t.Errorf("claimed %d distinct jobs, want %d", len(claimed), jobs)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %s claimed %d times", id, n)
+		}
+	}
+}
+
+func TestRunWorkersProcessesQueue(t *testing.T) {
+	ts := newTestServer(t)
+	stopWorkers, done := ts.startWorkers(2)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf"))
+	}
+	for _, id := range ids {
+		ts.waitForStatus(t, id, StatusComplete)
+	}
+	if n := len(ts.backend.Calls()); n != len(ids) {
+		t.Errorf("backend called %d times, want %d", n, len(ids))
+	}
+
+	stopWorkers()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers did not stop")
+	}
+}
+
+// waitForCalls waits until the backend was called n times.
+func (ts *testServer) waitForCalls(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ts.backend.Calls()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend called %d times, want %d", len(ts.backend.Calls()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (ts *testServer) cancel(t *testing.T, id string) *http.Response {
+	t.Helper()
+	return ts.do(t, http.MethodPost, "/converts/"+id+"/cancel", nil, "")
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+
+	if resp := ts.cancel(t, id); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: status %d", resp.StatusCode)
+	}
+	if job := ts.getJob(t, id); job.Status != StatusCancelled {
+		t.Errorf("status = %q, want %q", job.Status, StatusCancelled)
+	}
+	if _, err := os.Stat(filepath.Join(ts.converter.tempDir, id)); !os.IsNotExist(err) {
+		t.Errorf("job directory of cancelled job still exists: %v", err)
+	}
+	if _, err := ts.db.ClaimNextJob(StatusQueued, StatusProcessing); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("cancelled job can still be claimed: %v", err)
+	}
+}
+
+func TestCancelProcessingJob(t *testing.T) {
+	t.Setenv("FAKE_BACKEND_DELAY", "10s")
+	ts := newTestServer(t)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+
+	done := make(chan struct{})
+	go func() {
+		ts.work(t)
+		close(done)
+	}()
+	ts.waitForCalls(t, 1)
+
+	if resp := ts.cancel(t, id); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: status %d", resp.StatusCode)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conversion kept running after cancellation")
+	}
+
+	// The worker leaves the cancelled status alone
+	if job := ts.getJob(t, id); job.Status != StatusCancelled {
+		t.Errorf("status = %q, want %q", job.Status, StatusCancelled)
+	}
+	if _, err := os.Stat(filepath.Join(ts.converter.tempDir, id)); !os.IsNotExist(err) {
+		t.Errorf("job directory of cancelled job still exists: %v", err)
+	}
+}
+
+func TestCancelFinishedJob(t *testing.T) {
+	ts := newTestServer(t)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.work(t)
+
+	if resp := ts.cancel(t, id); resp.StatusCode != http.StatusConflict {
+		t.Errorf("cancel of complete job: status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if job := ts.getJob(t, id); job.Status != StatusComplete {
+		t.Errorf("status = %q, want %q", job.Status, StatusComplete)
+	}
+}
+
+// startWorkers runs count workers until the returned function stops them;
+// the channel is closed once they returned.
+func (ts *testServer) startWorkers(count int) (context.CancelFunc, <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ts.runWorkers(ctx, count)
+		close(done)
+	}()
+	return cancel, done
+}
+
+func TestDrainJobsWaitsForConversions(t *testing.T) {
+	t.Setenv("FAKE_BACKEND_DELAY", "200ms")
+	ts := newTestServer(t)
+	stopWorkers, workersDone := ts.startWorkers(1)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.waitForCalls(t, 1)
+
+	ts.beginShutdown()
+	stopWorkers()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ts.drainJobs(ctx, workersDone)
+
+	if job := ts.getJob(t, id); job.Status != StatusComplete {
+		t.Errorf("status after drain = %q, want %q", job.Status, StatusComplete)
+	}
+}
+
+func TestDrainJobsRequeuesAfterTimeout(t *testing.T) {
+	t.Setenv("FAKE_BACKEND_DELAY", "10s")
+	ts := newTestServer(t)
+	stopWorkers, workersDone := ts.startWorkers(1)
+	id := ts.upload(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	ts.waitForCalls(t, 1)
+
+	ts.beginShutdown()
+	stopWorkers()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ts.drainJobs(ctx, workersDone)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("drain took %s, want it cut off by the timeout", elapsed)
+	}
+
+	// Killed conversions are picked up again by the next start
+	if job := ts.getJob(t, id); job.Status != StatusQueued {
+		t.Errorf("status after drain = %q, want %q", job.Status, StatusQueued)
+	}
+}
+
+func TestShutdownRefusesConversions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.beginShutdown()
+
+	resp := ts.postConvert(t, "report.docx", makeDocx(t, "hello"), "pdf")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upload during shutdown: status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := resp.Header.Get("Retry-After"); got != shutdownRetryAfter {
+		t.Errorf("Retry-After = %q, want %q", got, shutdownRetryAfter)
+	}
+}